@@ -6,262 +6,549 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
-	"regexp"
 	"strings"
 	"time"
 
-	"github.com/davegardnerisme/deephash"
 	resty "github.com/go-resty/resty/v2"
-	"github.com/maja42/goval"
-	"github.com/tidwall/gjson"
+	"go.temporal.io/sdk/activity"
+	"go.temporal.io/sdk/temporal"
 )
 
 var errResourceNotFound = errors.New("ResourceNotFound")
 
-type ResourceUrl string
-type ActivityResult map[string]ResourceUrl
-
-func GetResourceWithRetries(resource_url string) (*resty.Response, error) {
-	client := resty.New().
-		SetRetryCount(5).
-		// Override initial retry wait time.
-		// Default is 100 milliseconds.
-		SetRetryWaitTime(1 * time.Second).
-		// MaxWaitTime can be overridden as well.
-		// Default is 2 seconds.
-		SetRetryMaxWaitTime(20 * time.Second)
+// ActivityResult is what an API activity returns to the workflow. Result is a snapshot of the
+// final representation of the resource (trimmed to the activity's outputs, if any). The workflow
+// records it and hands it to dependent activities, so value expressions are resolved from what
+// the workflow observed instead of re-fetching the resource.
+type ActivityResult struct {
+	ResourceUrl string
+	// Server is the name of the server of the resource, see CreatedResource
+	Server string
+	Result map[string]interface{}
+	// Request is the resolved request body the activity sent
+	Request map[string]interface{}
+	// IdempotencyKey is the request id which identified the resource of the activity
+	IdempotencyKey string
+}
+
+// Activities are the activities of a worker. They send their requests with the shared clients
+// of the worker and are registered together:
+//
+//	w.RegisterActivity(NewActivities(cfg))
+//
+// Workflows refer to them by method, e.g. (*Activities).ActivityProcessAPICall.
+type Activities struct {
+	Clients *ClientFactory
+	plugins *pluginRegistry
+}
+
+func NewActivities(cfg *WorkerConfig) *Activities {
+	clients := NewClientFactory(cfg)
+	return &Activities{Clients: clients, plugins: newPluginRegistry(clients.config)}
+}
+
+func GetResourceWithRetries(ctx context.Context, client *resty.Client, resource_url string) (*resty.Response, error) {
 	resp, err := client.R().
+		SetContext(ctx).
 		Get(resource_url)
 	return resp, err
 }
 
-func GetResourceIfExists(resourceCollectionUrl string,
-	workflowId string, activityName string) (string, error) {
-	hv := deephash.Hash(map[string]string{"workflowId": workflowId, "activityName": activityName})
-	hvs := fmt.Sprintf("%x", hv)
-	fmt.Println("x-request-id: ", string(hvs))
-	client := resty.New().
-		SetRetryCount(5).
-		// Override initial retry wait time.
-		// Default is 100 milliseconds.
-		SetRetryWaitTime(1 * time.Second).
-		// MaxWaitTime can be overridden as well.
-		// Default is 2 seconds.
-		SetRetryMaxWaitTime(20 * time.Second)
-	fmt.Println("GetResourceIfExists: ", resourceCollectionUrl)
-	resp, err := client.R().
-		AddRetryCondition(func(r *resty.Response, err error) bool {
-			fmt.Println("GetResourceIfExists: statusCode=", r.StatusCode())
-			return (r.StatusCode() == http.StatusTooManyRequests ||
-				r.StatusCode() == http.StatusServiceUnavailable)
-		}).
-		SetHeader("x-request-id", string(hvs)).
-		Get(resourceCollectionUrl)
-	if err != nil {
-		return "", err
-	} else {
-		if resp.StatusCode() == 200 {
-			// Read response
-			resourceBody := resp.Body()
-			resourceId := gjson.Get(string(resourceBody), "meta.resource_id").String()
-			resourceUrl, _ := url.JoinPath(resourceCollectionUrl, resourceId)
-			return resourceUrl, nil
-		} else if resp.StatusCode() == 404 {
-			return "", errResourceNotFound
-		} else {
-			return "", fmt.Errorf("ResourceGetError: %d", resp.StatusCode())
-		}
+// activityNamespaceObject describes the activity being executed to value expressions in the
+// `activity` namespace
+func activityNamespaceObject(activity *Activity, workflowMetadata WorkflowMetadata) map[string]interface{} {
+	return map[string]interface{}{
+		"name":       activity.Name,
+		"request_id": activity.requestId(workflowMetadata),
 	}
-
 }
 
-func ResolveValueExpressions(req map[string]interface{}, activityResponses map[string]string) {
+// ResolveValueExpressions replaces the value expressions in the request body of the activity
+// with values from the activities it depends on, the workflow metadata and the activity itself. A required
+// reference which cannot be resolved is replaced by nil, or fails with a non retryable
+// UnresolvedExpressionError if the activity is strict.
+func ResolveValueExpressions(activity *Activity, activityResults map[string]ActivityResult,
+	workflowMetadata WorkflowMetadata) error {
+	req := activity.RequestParams.Body
 	allMatches := []Match{}
-	var obj map[string]interface{}
-	allMatches = FindPathAndValuesWithPattern(regexp.MustCompile("{{.*}}"), req, []string{}, allMatches)
+	allMatches = FindPathAndValuesWithPattern(valueExpressionPattern, req, Path{}, allMatches)
 	log.Println("len allMatches: ", len(allMatches))
 
 	for _, m := range allMatches {
-		activityName := GetActivityNameFromValueExpression(m.value)
-		log.Println("ResolveValueExpressions: ", activityName)
-		activityResponse := activityResponses[activityName]
-		log.Println("ResolveValueExpressions: ", activityResponse)
-		response, _ := GetResourceWithRetries(activityResponse)
-		respObj := map[string]interface{}{}
-		json.Unmarshal(response.Body(), &respObj)
-		value := GetValue(respObj, m.value)
-		obj = req
-		for _, p := range m.pathArr[:len(m.pathArr)-1] {
-			obj = obj[p].(map[string]interface{})
+		value, err := InterpolateValueExpressions(m.value, func(ve string) (interface{}, error) {
+			expr, err := ParseValueExpression(ve)
+			if err != nil {
+				return nil, newInvalidExpressionError(activity.Name, err)
+			}
+			var obj map[string]interface{}
+			if expr.Activity == WorkflowNamespace {
+				obj = workflowMetadata.namespaceObject()
+			} else if expr.Activity == ActivityNamespace {
+				obj = activityNamespaceObject(activity, workflowMetadata)
+			} else {
+				activityResult, ok := activityResults[expr.Activity]
+				if !ok {
+					return nil, newMissingResultError(activity.Name, expr)
+				}
+				obj = activityResult.Result
+				if expr.Field == RequestField {
+					obj = activityResult.Request
+				}
+			}
+			value, err := expr.Evaluate(obj)
+			var notFound *PathNotFoundError
+			if errors.As(err, &notFound) {
+				if activity.Strict {
+					return nil, newUnresolvedExpressionError(activity.Name, expr, notFound)
+				}
+				log.Printf("ResolveValueExpressions: %s: %q is unresolved: %v", activity.Name, ve, err)
+				return nil, nil
+			}
+			return value, err
+		})
+		if err != nil {
+			return err
+		}
+		err = m.path.Set(req, value)
+		if err != nil {
+			return err
 		}
-		obj[m.pathArr[len(m.pathArr)-1]] = value
 	}
-	return
+	return nil
+}
+
+// getResource fetches the current representation of a resource
+func getResource(ctx context.Context, client *resty.Client, resourceUrl string) (map[string]interface{}, error) {
+	resp, err := GetResourceWithRetries(ctx, client, resourceUrl)
+	if err != nil {
+		return nil, fmt.Errorf("GetResourceError: %w", err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("GetResourceError: %w", newStatusError(resp))
+	}
+	respMap := map[string]interface{}{}
+	err = json.Unmarshal(resp.Body(), &respMap)
+	if err != nil {
+		return nil, fmt.Errorf("GetResourceError: %w", err)
+	}
+	return respMap, nil
 }
 
-func getResourceServerUrl(resourcePath string) string {
-	cas_server := os.Getenv("CAS_SERVER")
-	post_endpoint, _ := url.JoinPath(cas_server, resourcePath)
+func getResourceServerUrl(server ServerConfig, resourcePath string) string {
+	post_endpoint, _ := url.JoinPath(server.BaseUrl, resourcePath)
 	return post_endpoint
 }
 
-func createResource(ctx context.Context, activity *Activity,
-	workFlowId string, reqJson []byte) (error, string) {
-	fmt.Println("createResource: ", activity.RequestParams.Path)
-	post_endpoint := getResourceServerUrl(activity.ActivityParams.RequestParams.Path)
-	client := resty.New()
-	hv := deephash.Hash(map[string]string{"workflowId": workFlowId, "activityName": activity.Name})
-	hvs := fmt.Sprintf("%x", hv)
+// createResource creates the resource of the activity and returns its url. The request carries
+// the request id of the activity, and its workflow id and name (see IdentityHeaders), which the
+// lookup of the activity can match on. Any 2xx response is accepted; if the backend accepted the request for
+// asynchronous processing, the operation is tracked until the resource is created, see
+// OperationParams.
+func createResource(ctx context.Context, client *resty.Client, activity *Activity, kind ResourceKind,
+	serverUrl string, post_endpoint string, workflowMetadata WorkflowMetadata, reqJson []byte) (string, error) {
 	resp, err := client.R().
-		AddRetryCondition(func(r *resty.Response, err error) bool {
-			return (r.StatusCode() == http.StatusTooManyRequests ||
-				r.StatusCode() == http.StatusServiceUnavailable)
-		}).
-		SetHeader("x-request-id", string(hvs)).
+		SetContext(ctx).
+		SetHeader(kind.Lookup.requestIdHeader(), activity.requestId(workflowMetadata)).
 		SetBody(reqJson).Post(post_endpoint)
+	if err != nil {
+		return "", fmt.Errorf("CreateResourceError: %w", err)
+	}
+	if !resp.IsSuccess() {
+		return "", fmt.Errorf("CreateResourceError: %w", newStatusError(resp))
+	}
+	body, location := resp.Body(), resp.Header().Get("Location")
+	operationUrl, err := operationUrlOf(resp, kind.Operation)
+	if err != nil {
+		return "", err
+	}
+	if operationUrl != "" {
+		if strings.EqualFold(kind.Operation.withDefaults().Header, "Location") {
+			location = ""
+		}
+		resourceLocation, operationBody, err := waitForOperation(ctx, client, activity, kind.Operation, operationUrl)
+		if err != nil {
+			return "", err
+		}
+		if location == "" {
+			location = resourceLocation
+		}
+		if location == "" {
+			// The id of the resource is taken from the result of the operation
+			body = operationBody
+		}
+	}
+	return resourceUrlOf(ctx, activity, kind, serverUrl, post_endpoint, body, location, workflowMetadata)
+}
 
-	respMap := map[string]interface{}{}
+// Defaults of the wait policy of an activity
+const (
+	defaultWaitInitialInterval = 5 * time.Second
+	defaultWaitMultiplier      = 2.0
+	defaultWaitMaxInterval     = 5 * time.Minute
+)
+
+func (w WaitParams) withDefaults() WaitParams {
+	if w.InitialInterval <= 0 {
+		w.InitialInterval = defaultWaitInitialInterval
+	}
+	if w.Multiplier < 1 {
+		w.Multiplier = defaultWaitMultiplier
+	}
+	if w.MaxInterval <= 0 {
+		w.MaxInterval = defaultWaitMaxInterval
+	}
+	return w
+}
+
+// validate checks that jittered intervals cannot be negative
+func (w WaitParams) validate() error {
+	if w.Jitter < 0 || w.Jitter > 1 {
+		return fmt.Errorf("wait: jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// heartbeat records heartbeats of the activity of ctx while it waits, until stop is called, if
+// the activity has a heartbeat timeout, see activityOptions
+func heartbeat(ctx context.Context) (stop func()) {
+	if !activity.IsActivity(ctx) || activity.GetInfo(ctx).HeartbeatTimeout <= 0 {
+		return func() {}
+	}
+	ticker := time.NewTicker(activity.GetInfo(ctx).HeartbeatTimeout / 2)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				activity.RecordHeartbeat(ctx)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// jittered randomizes interval by up to the jitter fraction of the wait policy
+func (w WaitParams) jittered(interval time.Duration) time.Duration {
+	if w.Jitter <= 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * (1 + w.Jitter*(2*rand.Float64()-1)))
+}
+
+// WaitForCompletenessConditionCriteria waits until the completeness condition of the activity
+// holds and returns the representation of the resource which satisfied it. The resource is
+// polled following the wait policy of the activity, or watched first if the policy has a watch
+// mode, see watchResource. If the failure condition of the activity holds first, waiting stops
+// with a non retryable ResourceFailedError. Invalid conditions and evaluation errors fail with
+// non retryable application errors as well. Without a completeness condition the resource is
+// complete as soon as it exists.
+func WaitForCompletenessConditionCriteria(ctx context.Context, client *resty.Client, activity *Activity,
+	resourceUrl string) (map[string]interface{}, error) {
+
+	conditions, err := parseActivityConditions(activity, resourceUrl)
 	if err != nil {
-		return fmt.Errorf("CreateResourceError: Post Failed"), ""
-	} else {
-		if resp.StatusCode() == http.StatusOK {
-			// Read response
-			respBody := resp.Body()
-			json.Unmarshal(respBody, &respMap)
-			resource_id := respMap["meta"].(map[string]interface{})["resource_id"].(string)
-			resource_url, _ := url.JoinPath(post_endpoint, resource_id)
-			return nil, resource_url
-		} else {
-			return fmt.Errorf("CreateResourceError"), ""
+		return nil, err
+	}
+
+	defer heartbeat(ctx)()
+	wait := activity.Wait.withDefaults()
+	if wait.Mode == WaitModeSSE || wait.Mode == WaitModeLongPoll {
+		watchCtx := ctx
+		if wait.MaxDuration > 0 {
+			var cancel context.CancelFunc
+			watchCtx, cancel = context.WithTimeout(ctx, wait.MaxDuration)
+			defer cancel()
+		}
+		respMap, err := watchResource(watchCtx, client, wait, resourceUrl,
+			func(respMap map[string]interface{}) (bool, error) { return conditions.evaluate(ctx, respMap) })
+		if err == nil {
+			return respMap, nil
+		}
+		var appErr *temporal.ApplicationError
+		if errors.As(err, &appErr) || ctx.Err() != nil {
+			return nil, err
 		}
+		log.Printf("WaitForCompletenessConditionCriteria: %s: watching %s failed, falling back to polling: %v",
+			activity.Name, resourceUrl, err)
 	}
+
+	return conditions.poll(ctx, func(ctx context.Context) (map[string]interface{}, error) {
+		return getResource(ctx, client, resourceUrl)
+	})
 }
 
-func WaitForCompletenessConditionCriteria(completenessCondition string, resourceUrl string) error {
+// activityConditions are the completeness and failure conditions of an activity, checked
+// against the representations of its resource
+type activityConditions struct {
+	activity    *Activity
+	resourceUrl string
+	// start is when waiting for the conditions started
+	start        time.Time
+	completeness *Condition
+	failure      *Condition
+}
 
-	sleepTime := 5
+func parseActivityConditions(activity *Activity, resourceUrl string) (*activityConditions, error) {
+	conditions := &activityConditions{activity: activity, resourceUrl: resourceUrl, start: time.Now()}
+	var err error
+	if activity.CompletenessCondition != "" {
+		conditions.completeness, err = ParseCondition(activity.CompletenessCondition)
+		if err != nil {
+			return nil, newInvalidExpressionError(activity.Name, err)
+		}
+	}
+	if activity.FailureCondition != "" {
+		conditions.failure, err = ParseCondition(activity.FailureCondition)
+		if err != nil {
+			return nil, newInvalidExpressionError(activity.Name, err)
+		}
+	}
+	return conditions, nil
+}
+
+// evaluate checks the conditions against a representation of the resource
+func (c *activityConditions) evaluate(ctx context.Context, respMap map[string]interface{}) (bool, error) {
+	if c.failure != nil {
+		failed, err := c.failure.Evaluate(respMap)
+		if err != nil {
+			return false, newConditionEvaluationError(ctx, c.activity.Name, c.resourceUrl, err)
+		}
+		if failed {
+			return false, newResourceFailedError(ctx, c.activity, c.resourceUrl, respMap)
+		}
+	}
+	if c.completeness == nil {
+		return true, nil
+	}
+	complete, err := c.completeness.Evaluate(respMap)
+	if err != nil {
+		return false, newConditionEvaluationError(ctx, c.activity.Name, c.resourceUrl, err)
+	}
+	return complete, nil
+}
+
+// poll fetches the representation of the resource following the wait policy of the activity
+// until it is complete
+func (c *activityConditions) poll(ctx context.Context,
+	fetch func(context.Context) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	wait := c.activity.Wait.withDefaults()
+	interval := wait.InitialInterval
 	for {
-		var respMap map[string]interface{}
-		resp, err := GetResourceWithRetries(resourceUrl)
+		respMap, err := fetch(ctx)
 		if err != nil {
-			// Wraps error with custom error
-			return fmt.Errorf("GetResourceError: %w", err)
+			return nil, err
 		}
 
-		json.Unmarshal(resp.Body(), &respMap)
-		// Replace any single quoted string literals to double quoted string literals
-		// e.g " {{ foo.boo }} == 'created' " will be transformed to
-		//  {{ foo.boo }} == "created"
-		var re = regexp.MustCompile(`'([A-Za-z0-9\.\-_]*)'`)
-		s := re.ReplaceAllString(completenessCondition, `"$1"`)
-
-		re1 := regexp.MustCompile(`{{\s*([A-Za-z0-9_\-\.]*)\s*}}`)
-		ms := re1.FindAllStringSubmatch(s, -1)
-		for _, v := range ms {
-			value := GetValue(respMap, v[1])
-			strVal, ok := value.(string)
-			if ok {
-				strVal = fmt.Sprintf("%q", strVal)
-				s = strings.Replace(s, v[0], strVal, -1)
-			} else {
-				// TODO: Handle non string values
-				return fmt.Errorf("NonStringValuesNotSupported")
-			}
+		complete, err := c.evaluate(ctx, respMap)
+		if err != nil {
+			return nil, err
+		}
+		if complete {
+			return respMap, nil
 		}
 
-		fmt.Println("+++++++++++++++", s)
-
-		eval := goval.NewEvaluator()
-		result, _ := eval.Evaluate(s, nil, nil) // Returns <true, nil>
-		resultB := result.(bool)
-		if resultB {
-			return nil
-		} else {
-			time.Sleep(time.Duration(sleepTime) * time.Second)
-			sleepTime = sleepTime * 2
-			if sleepTime > 700 {
-				sleepTime = 5
-			} else {
-				sleepTime = sleepTime * 2
+		sleepTime := wait.jittered(interval)
+		if wait.MaxDuration > 0 {
+			remaining := wait.MaxDuration - time.Since(c.start)
+			if remaining <= 0 {
+				return nil, newConditionTimeoutError(ctx, c.activity, c.resourceUrl, time.Since(c.start),
+					c.completeness.Values(respMap))
 			}
+			if sleepTime > remaining {
+				sleepTime = remaining
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleepTime):
+		}
+		interval = time.Duration(float64(interval) * wait.Multiplier)
+		if interval > wait.MaxInterval {
+			interval = wait.MaxInterval
 		}
 	}
-	// TODO: Handle timeout
-	return fmt.Errorf("Workflow completeness check control should never reach here")
 }
 
 //  1. Check if the resource request body has any value expressions depending on other activities
-//  2. If yes, then resolve the value expressions and create the request body
+//  2. If yes, then resolve the value expressions from the results of those activities and create the request body
 //  3. Check if the resource exists. This is important for idempotency of activity. Suppose a
 //     resource has been created and the acitvity was in post condition wait state. Now the activity
 //     is retried. In this case, the activity should not create the resource again
 //
 // 4. If the resource does not exist, then create the resource
 // 5. If the resource exists, then check for post condition criteria to be met
-func ActivityProcessAPICall(ctx context.Context, activity *Activity,
-	activityResults map[string]string, workFlowId string) (string, error) {
+// 6. Return a snapshot of the final resource representation, projected on the activity outputs
+func (a *Activities) ActivityProcessAPICall(ctx context.Context, activity *Activity,
+	activityResults map[string]ActivityResult, workflowMetadata WorkflowMetadata) (ActivityResult, error) {
 
+	ctx, storeTranscript := a.startTranscript(ctx, activityIdentity(ctx, activity.Name, workflowMetadata))
+	defer storeTranscript()
 	var resourceUrl string
-	ResolveValueExpressions(activity.RequestParams.Body, activityResults)
+	server, err := a.Clients.Server(activity)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	client, err := a.Clients.Client(server)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	collectionUrl := getResourceServerUrl(server, activity.RequestParams.Path)
+	kind := resourceKindFor(activity, server)
 
-	reqJson, err := json.Marshal(activity.RequestParams.Body)
+	reqJson, err := resolveRequestBody(activity, activityResults, workflowMetadata)
 	if err != nil {
-		fmt.Errorf("RequestMarshalError")
-		return "", err
+		return ActivityResult{}, err
 	}
 
 	switch activity.RequestParams.Method {
 	case "POST":
 		// Check if resource exists
-		resourceUrl, err = GetResourceIfExists(
-			getResourceServerUrl(activity.ActivityParams.RequestParams.Path), workFlowId, activity.Name)
-		if err != nil {
-			fmt.Println("GetResourceError error:", err)
-		}
+		resourceUrl, err = GetResourceIfExists(ctx, client, server.BaseUrl, collectionUrl, kind, activity, workflowMetadata)
 		if err == errResourceNotFound {
-			err, resourceUrl = createResource(ctx, activity, workFlowId, reqJson)
+			resourceUrl, err = createResource(ctx, client, activity, kind, server.BaseUrl, collectionUrl, workflowMetadata, reqJson)
 			if err != nil {
-				fmt.Println("CreateResourceError error:", err)
-				return "", fmt.Errorf("ActivityProcessAPICall failed: %w", err)
-			} else {
-				fmt.Println("CreateResource success")
+				return ActivityResult{}, httpActivityError(ctx, activity.Name, "ActivityProcessAPICall failed", err, a.Clients.retryableStatus(server))
 			}
 		} else if err != nil {
-			return "", fmt.Errorf("ActivityProcessAPICall failed: %w", err)
-		} else {
-			fmt.Println("Resource already exists")
+			return ActivityResult{}, httpActivityError(ctx, activity.Name, "ActivityProcessAPICall failed", err, a.Clients.retryableStatus(server))
 		}
 	case "GET":
 		fmt.Println("GET: To be implemented")
 	}
 
 	// Check if post condition criteria is met
-	if activity.CompletenessCondition != "" {
-		// Check if post condition criteria is met
-		err := WaitForCompletenessConditionCriteria(activity.CompletenessCondition, resourceUrl)
-		if err == nil {
-			activityResults[activity.Name] = resourceUrl
-			return resourceUrl, nil
-		} else { // Post condition criteria not met
-			return "", fmt.Errorf("WaitForCompletenessConditionCriteriaError")
+	resource, err := WaitForCompletenessConditionCriteria(ctx, client, activity, resourceUrl)
+	if err != nil { // Post condition criteria not met
+		return ActivityResult{}, httpActivityError(ctx, activity.Name, "WaitForCompletenessConditionCriteriaError", err,
+			a.Clients.retryableStatus(server))
+	}
+
+	return ActivityResult{
+		ResourceUrl:    resourceUrl,
+		Server:         activity.serverName(),
+		Result:         ProjectOutputs(resource, activity.Outputs),
+		Request:        activity.RequestParams.Body,
+		IdempotencyKey: activity.key,
+	}, nil
+}
+
+// resolveRequestBody computes the idempotency key of the activity, resolves the value
+// expressions of its request body and returns the resolved body as JSON. The body can refer to
+// the idempotency key, unless the key is derived from the body.
+func resolveRequestBody(activity *Activity, activityResults map[string]ActivityResult,
+	workflowMetadata WorkflowMetadata) ([]byte, error) {
+	var err error
+	activity.key = ""
+	if !keyNeedsBody(activity.IdempotencyKey) {
+		activity.key, err = idempotencyKey(activity, workflowMetadata, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ResolveValueExpressions(activity, activityResults, workflowMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	reqJson, err := json.Marshal(activity.RequestParams.Body)
+	if err != nil {
+		return nil, newRequestMarshalError(activity.Name, err)
+	}
+	if keyNeedsBody(activity.IdempotencyKey) {
+		activity.key, err = idempotencyKey(activity, workflowMetadata, reqJson)
+		if err != nil {
+			return nil, err
 		}
 	}
+	return reqJson, nil
+}
 
-	return "", fmt.Errorf("Activity completion criteria not met")
+// dependencyResults returns the results of the activities the activity depends on. It must be
+// called before the value expressions of the activity are resolved.
+func dependencyResults(activity *Activity, activityResults map[string]ActivityResult) map[string]ActivityResult {
+	dependencies := map[string]ActivityResult{}
+	for _, name := range FindDependencies(activity) {
+		if result, ok := activityResults[name]; ok {
+			dependencies[name] = result
+		}
+	}
+	return dependencies
 }
 
-func CleanupActivity(ctx context.Context, resourceUrls []string) (string, error) {
-	for _, resourceUrl := range resourceUrls {
-		// Make http Delete request to delete resource
-		resp, err := http.NewRequest("DELETE", resourceUrl, nil)
+// dependencyObjects describes the results of dependencies to the code of script and wasm
+// activities, as `{"<activity>": {"result": ..., "request": ...}}`
+func dependencyObjects(results map[string]ActivityResult) map[string]interface{} {
+	dependencies := map[string]interface{}{}
+	for name, result := range results {
+		dependencies[name] = map[string]interface{}{"result": result.Result, "request": result.Request}
+	}
+	return dependencies
+}
+
+// resultObject returns the result of an activity whose code returned value: a JSON object is
+// the result, any other value is its `value`.
+func resultObject(value interface{}) map[string]interface{} {
+	if result, ok := value.(map[string]interface{}); ok {
+		return result
+	}
+	return map[string]interface{}{"value": value}
+}
+
+// startTranscript binds the requests of an activity attempt to the identity of the activity and
+// records their transcript. The returned function stores the transcript when the attempt ends,
+// see TranscriptConfig.
+func (a *Activities) startTranscript(ctx context.Context, identity requestIdentity) (context.Context, func()) {
+	recorder := newTranscriptRecorder(a.Clients.config.Transcripts, identity)
+	ctx = withTranscript(withRequestIdentity(ctx, identity), recorder)
+	return ctx, func() {
+		err := recorder.store()
+		if err != nil {
+			log.Printf("%s: %v", identity.ActivityName, err)
+		}
+	}
+}
+
+// CreatedResource is a resource created by an activity of a workflow, which CleanupActivity
+// deletes if the workflow fails. Server is the name of the server of the activity and
+// ServerConfig its declaration, if the workflow declares it, so that the resource is deleted
+// with the settings and credentials it was created with.
+type CreatedResource struct {
+	Url          string
+	Server       string
+	ServerConfig *ServerConfig
+}
+
+// CleanupActivity deletes the resources created by a workflow. Resources which are already
+// gone are skipped.
+func (a *Activities) CleanupActivity(ctx context.Context, resources []CreatedResource) (string, error) {
+	ctx, storeTranscript := a.startTranscript(ctx, activityIdentity(ctx, "CleanupActivity", WorkflowMetadata{}))
+	defer storeTranscript()
+	for _, resource := range resources {
+		server, err := a.Clients.Server(&Activity{
+			ActivityParams: ActivityParams{Name: "CleanupActivity", Server: resource.Server},
+			ServerConfig:   resource.ServerConfig,
+		})
+		if err != nil {
+			return "", err
+		}
+		client, err := a.Clients.Client(server)
 		if err != nil {
-			fmt.Errorf("ResourceDeleteError")
 			return "", err
-		} else {
-			defer resp.Body.Close()
+		}
+		resp, err := client.R().SetContext(ctx).Delete(resource.Url)
+		if err != nil {
+			return "", fmt.Errorf("ResourceDeleteError: %w", err)
+		}
+		if !resp.IsSuccess() && resp.StatusCode() != http.StatusNotFound {
+			return "", httpActivityError(ctx, "CleanupActivity", "ResourceDeleteError", newStatusError(resp),
+				a.Clients.retryableStatus(server))
 		}
 	}
 	return "Success", nil
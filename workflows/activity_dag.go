@@ -1,20 +1,31 @@
 package workflows
 
 import (
-	"regexp"
-	"strings"
-
 	"github.com/heimdalr/dag"
 )
 
 func FindDependencies(activity *Activity) []string {
 	dependencies := []string{}
-	allMatches := FindPathAndValuesWithPattern(regexp.MustCompile("{{.*}}"),
-		activity.RequestParams.Body, []string{}, []Match{})
+	seen := map[string]bool{}
+	for _, activityName := range activity.DependsOn {
+		if !seen[activityName] {
+			seen[activityName] = true
+			dependencies = append(dependencies, activityName)
+		}
+	}
+	allMatches := FindPathAndValuesWithPattern(valueExpressionPattern,
+		activity.RequestParams.Body, Path{}, []Match{})
 	for _, match := range allMatches {
-		matchVal := strings.TrimSpace(match.value[2 : len(match.value)-2])
-		activityName := GetActivityNameFromValueExpression(matchVal)
-		dependencies = append(dependencies, activityName)
+		for _, ve := range FindValueExpressions(match.value) {
+			activityName := GetActivityNameFromValueExpression(ve)
+			if activityName == WorkflowNamespace || activityName == ActivityNamespace {
+				continue
+			}
+			if !seen[activityName] {
+				seen[activityName] = true
+				dependencies = append(dependencies, activityName)
+			}
+		}
 	}
 
 	return dependencies
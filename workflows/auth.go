@@ -0,0 +1,288 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the authentication of requests to a server
+const (
+	AuthBearer                  = "bearer"
+	AuthApiKey                  = "api_key"
+	AuthOAuth2ClientCredentials = "oauth2_client_credentials"
+)
+
+const (
+	defaultApiKeyHeader       = "X-API-Key"
+	defaultTokenRefreshBefore = time.Minute
+)
+
+// AuthConfig configures how requests to a server are authenticated:
+//
+//   - bearer: a static `Authorization: Bearer <token>` header
+//   - api_key: a static key sent in Header (X-API-Key by default)
+//   - oauth2_client_credentials: an access token obtained from TokenUrl with the client
+//     credentials grant. Tokens are cached by the worker and refreshed RefreshBefore their
+//     expiry (one minute by default, at most half of their lifetime). The token endpoint is not the server: its connections
+//     are verified with the system roots, or configured with TLS.
+//
+// Mutual TLS is configured with the client certificate of the TLS configuration of the server.
+type AuthConfig struct {
+	Type          string        `yaml:"type"`
+	Token         string        `yaml:"token"`
+	Header        string        `yaml:"header"`
+	Key           string        `yaml:"key"`
+	TokenUrl      string        `yaml:"token_url"`
+	ClientId      string        `yaml:"client_id"`
+	ClientSecret  string        `yaml:"client_secret"`
+	Scopes        []string      `yaml:"scopes"`
+	RefreshBefore time.Duration `yaml:"refresh_before"`
+	TLS           TLSConfig     `yaml:"tls"`
+}
+
+func (a AuthConfig) validate() error {
+	switch a.Type {
+	case "":
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("auth: bearer requires a token")
+		}
+	case AuthApiKey:
+		if a.Key == "" {
+			return fmt.Errorf("auth: api_key requires a key")
+		}
+	case AuthOAuth2ClientCredentials:
+		if a.TokenUrl == "" || a.ClientId == "" {
+			return fmt.Errorf("auth: oauth2_client_credentials requires a token_url and a client_id")
+		}
+		if (a.TLS.CertFile == "") != (a.TLS.KeyFile == "") {
+			return fmt.Errorf("auth: tls: cert_file and key_file must be set together")
+		}
+	default:
+		return fmt.Errorf("auth: unknown type %q", a.Type)
+	}
+	return nil
+}
+
+// authTransport authenticates every request sent through it, including the requests watching
+// resources.
+type authTransport struct {
+	base   http.RoundTripper
+	auth   AuthConfig
+	tokens *oauth2TokenSource
+}
+
+func newAuthTransport(base http.RoundTripper, auth AuthConfig) (http.RoundTripper, error) {
+	if auth.Type == "" {
+		return base, nil
+	}
+	t := &authTransport{base: base, auth: auth}
+	if auth.Type == AuthOAuth2ClientCredentials {
+		var err error
+		t.tokens, err = sharedTokenSource(auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	switch t.auth.Type {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+t.auth.Token)
+	case AuthApiKey:
+		header := t.auth.Header
+		if header == "" {
+			header = defaultApiKeyHeader
+		}
+		req.Header.Set(header, t.auth.Key)
+	case AuthOAuth2ClientCredentials:
+		token, err := t.tokens.token(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && t.tokens != nil {
+		// The token may have been revoked, the next attempt fetches a new one
+		t.tokens.invalidate()
+	}
+	return resp, err
+}
+
+// oauth2TokenSource fetches access tokens with the client credentials grant and caches them
+// until shortly before they expire. A single token is fetched at a time, the requests needing
+// one meanwhile wait for it.
+type oauth2TokenSource struct {
+	auth   AuthConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	// refreshAt is when the token is refreshed, shortly before it expires
+	refreshAt time.Time
+	fetch     *tokenFetch
+}
+
+// tokenFetch is a token request in flight
+type tokenFetch struct {
+	done chan struct{}
+	err  error
+	// cancelled tells that the request needing the token was cancelled, which does not fail
+	// the requests waiting for the token
+	cancelled bool
+}
+
+// tokenSources are shared by all clients of the worker using the same credentials, so that
+// activities reuse cached tokens.
+var (
+	tokenSourcesLock sync.Mutex
+	tokenSources     = map[string]*oauth2TokenSource{}
+)
+
+func sharedTokenSource(auth AuthConfig) (*oauth2TokenSource, error) {
+	key := strings.Join([]string{auth.TokenUrl, auth.ClientId, auth.ClientSecret,
+		strings.Join(auth.Scopes, " "), auth.TLS.CAFile, auth.TLS.CertFile, auth.TLS.KeyFile,
+		auth.TLS.ServerName, fmt.Sprint(auth.TLS.InsecureSkipVerify)}, "\x00")
+	tokenSourcesLock.Lock()
+	defer tokenSourcesLock.Unlock()
+	ts, ok := tokenSources[key]
+	if ok {
+		return ts, nil
+	}
+	tlsConfig, err := auth.TLS.clientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("auth: tls: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	ts = &oauth2TokenSource{auth: auth, client: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+	tokenSources[key] = ts
+	return ts, nil
+}
+
+func (ts *oauth2TokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.accessToken = ""
+}
+
+// token returns a valid access token, fetching one if needed. The token is fetched within the
+// context of the request needing it.
+func (ts *oauth2TokenSource) token(ctx context.Context) (string, error) {
+	for {
+		ts.mu.Lock()
+		if ts.accessToken != "" && time.Now().Before(ts.refreshAt) {
+			token := ts.accessToken
+			ts.mu.Unlock()
+			return token, nil
+		}
+		fetch := ts.fetch
+		if fetch == nil {
+			fetch = &tokenFetch{done: make(chan struct{})}
+			ts.fetch = fetch
+			ts.mu.Unlock()
+			return ts.fetchToken(ctx, fetch)
+		}
+		ts.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("TokenError: %w", ctx.Err())
+		case <-fetch.done:
+		}
+		if fetch.err != nil && !fetch.cancelled {
+			return "", fetch.err
+		}
+	}
+}
+
+// refreshBefore returns how long before it expires a token living for expiresIn is refreshed, at
+// most half of its lifetime so that short-lived tokens are still reused
+func (ts *oauth2TokenSource) refreshBefore(expiresIn time.Duration) time.Duration {
+	refreshBefore := ts.auth.RefreshBefore
+	if refreshBefore <= 0 {
+		refreshBefore = defaultTokenRefreshBefore
+	}
+	if refreshBefore > expiresIn/2 {
+		return expiresIn / 2
+	}
+	return refreshBefore
+}
+
+// fetchToken fetches a token and caches it, then completes fetch
+func (ts *oauth2TokenSource) fetchToken(ctx context.Context, fetch *tokenFetch) (string, error) {
+	token, expiresIn, err := ts.requestToken(ctx)
+	ts.mu.Lock()
+	if err == nil {
+		ts.accessToken = token
+		ts.refreshAt = time.Now().Add(expiresIn - ts.refreshBefore(expiresIn))
+		if expiresIn <= 0 {
+			// Tokens without an expiry are cached for an hour
+			ts.refreshAt = time.Now().Add(time.Hour)
+		}
+	}
+	fetch.err = err
+	fetch.cancelled = ctx.Err() != nil
+	ts.fetch = nil
+	ts.mu.Unlock()
+	close(fetch.done)
+	return token, err
+}
+
+// requestToken requests a token from the token endpoint and returns it with its lifetime
+func (ts *oauth2TokenSource) requestToken(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", ts.auth.ClientId)
+	form.Set("client_secret", ts.auth.ClientSecret)
+	if len(ts.auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.auth.Scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.auth.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("TokenError: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("TokenError: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", 0, fmt.Errorf("TokenError: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("TokenError: %w", &StatusError{
+			Method:     http.MethodPost,
+			Url:        ts.auth.TokenUrl,
+			StatusCode: resp.StatusCode,
+			Body:       body,
+		})
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.Unmarshal(body, &tokenResp)
+	if err != nil {
+		return "", 0, fmt.Errorf("TokenError: %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", 0, fmt.Errorf("TokenError: no access_token in response")
+	}
+	return tokenResp.AccessToken, time.Duration(tokenResp.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,367 @@
+package workflows
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// authServer records the authorization headers of the requests it receives
+type authServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers []http.Header
+	status  int
+}
+
+func newAuthServer() *authServer {
+	s := &authServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.headers = append(s.headers, r.Header.Clone())
+		status := s.status
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{}`))
+	}))
+	return s
+}
+
+func (s *authServer) setStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+func (s *authServer) last() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.headers[len(s.headers)-1]
+}
+
+func TestStaticAuth(t *testing.T) {
+	server := newAuthServer()
+	defer server.Close()
+
+	client, err := newServerClient(ServerConfig{BaseUrl: server.URL, Auth: AuthConfig{Type: AuthBearer, Token: "secret"}}, ClientConfig{}, nil, nil)
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", server.last().Get("Authorization"))
+
+	client, err = newServerClient(ServerConfig{BaseUrl: server.URL, Auth: AuthConfig{Type: AuthApiKey, Key: "key"}}, ClientConfig{}, nil, nil)
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", server.last().Get(defaultApiKeyHeader))
+
+	client, err = newServerClient(ServerConfig{BaseUrl: server.URL,
+		Auth: AuthConfig{Type: AuthApiKey, Header: "x-api-token", Key: "key"}}, ClientConfig{}, nil, nil)
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", server.last().Get("x-api-token"))
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	tokenServer := httptest.NewServer(newMockRouter())
+	defer tokenServer.Close()
+	server := newAuthServer()
+	defer server.Close()
+
+	auth := AuthConfig{
+		Type:         AuthOAuth2ClientCredentials,
+		TokenUrl:     tokenServer.URL + "/oauth/token",
+		ClientId:     mockClientId,
+		ClientSecret: mockClientSecret,
+	}
+	get := func() string {
+		// Clients of different workers share the tokens too
+		client, err := newServerClient(ServerConfig{BaseUrl: server.URL, Auth: auth}, ClientConfig{}, nil, nil)
+		assert.NoError(t, err)
+		_, err = client.R().Get(server.URL)
+		assert.NoError(t, err)
+		return server.last().Get("Authorization")
+	}
+
+	token := get()
+	assert.Regexp(t, "^Bearer mock-token-", token)
+	assert.Equal(t, token, get())
+
+	// A rejected token is fetched again
+	server.setStatus(http.StatusUnauthorized)
+	get()
+	server.setStatus(http.StatusOK)
+	refreshed := get()
+	assert.NotEqual(t, token, refreshed)
+
+	auth.Scopes = []string{"invalid"}
+	auth.ClientSecret = "wrong"
+	client, err := newServerClient(ServerConfig{BaseUrl: server.URL, Auth: auth}, ClientConfig{RetryCount: -1}, nil, nil)
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	var statusErr *StatusError
+	assert.ErrorAs(t, err, &statusErr)
+	assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	// The token endpoint issues tokens living for the expires_in of the scope
+	var fetches atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": %s}`,
+			fetches.Add(1), r.Form.Get("scope"))
+	}))
+	defer tokenServer.Close()
+
+	token := func(expiresIn string) func() string {
+		ts, err := sharedTokenSource(AuthConfig{Type: AuthOAuth2ClientCredentials, TokenUrl: tokenServer.URL,
+			ClientId: "refresh", Scopes: []string{expiresIn}})
+		assert.NoError(t, err)
+		return func() string {
+			token, err := ts.token(context.Background())
+			assert.NoError(t, err)
+			return token
+		}
+	}
+
+	// Tokens living less than RefreshBefore (one minute by default) are reused for half of their
+	// lifetime
+	get := token("60")
+	assert.Equal(t, get(), get())
+	assert.Equal(t, int32(1), fetches.Load())
+
+	get = token("1")
+	first := get()
+	assert.Equal(t, first, get())
+	time.Sleep(600 * time.Millisecond)
+	assert.NotEqual(t, first, get())
+}
+
+func TestParseAuthConfig(t *testing.T) {
+	os.Setenv("TEST_CLIENT_SECRET", "from-env")
+	defer os.Unsetenv("TEST_CLIENT_SECRET")
+
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  packaging:
+    base_url: https://packaging.example.com
+    auth:
+      type: oauth2_client_credentials
+      token_url: https://auth.example.com/oauth/token
+      client_id: workflows
+      client_secret: ${TEST_CLIENT_SECRET}
+      scopes: [packaging]
+      refresh_before: 30s
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, AuthConfig{
+		Type:          AuthOAuth2ClientCredentials,
+		TokenUrl:      "https://auth.example.com/oauth/token",
+		ClientId:      "workflows",
+		ClientSecret:  "from-env",
+		Scopes:        []string{"packaging"},
+		RefreshBefore: 30 * time.Second,
+	}, cfg.Servers["packaging"].Auth)
+
+	for _, c := range []string{
+		"auth: {type: bearer}",
+		"auth: {type: api_key}",
+		"auth: {type: oauth2_client_credentials, client_id: workflows}",
+		"auth: {type: basic}",
+		"tls: {cert_file: client.pem}",
+	} {
+		_, err := ParseWorkerConfig([]byte("servers:\n  s:\n    base_url: https://s\n    " + c + "\n"))
+		assert.Error(t, err, c)
+	}
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key to dir
+func writeClientCertificate(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "workflows"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return cert, certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, certFile, keyFile := writeClientCertificate(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	client, err := newServerClient(ServerConfig{BaseUrl: server.URL, TLS: TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}}, ClientConfig{}, nil, nil)
+	assert.NoError(t, err)
+	resp, err := client.R().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "workflows", resp.String())
+
+	// Without the client certificate the handshake fails
+	client, err = newServerClient(ServerConfig{BaseUrl: server.URL, TLS: TLSConfig{CAFile: caFile}}, ClientConfig{RetryCount: -1}, nil, nil)
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	assert.Error(t, err)
+}
+
+func TestOAuth2TokenEndpointTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, certFile, keyFile := writeClientCertificate(t, dir)
+
+	// The backend requires the client certificate of the worker
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+	backendCA := filepath.Join(dir, "backend-ca.pem")
+	assert.NoError(t, os.WriteFile(backendCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0o600))
+
+	// The token endpoint does not see the certificate of the worker for the backend
+	var clientCertificates atomic.Int32
+	tokenServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientCertificates.Add(int32(len(r.TLS.PeerCertificates)))
+		oauthToken(w, r)
+	}))
+	tokenServer.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	tokenServer.StartTLS()
+	defer tokenServer.Close()
+	tokenCA := filepath.Join(dir, "token-ca.pem")
+	assert.NoError(t, os.WriteFile(tokenCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tokenServer.Certificate().Raw}), 0o600))
+
+	get := func(auth AuthConfig) (string, error) {
+		server := ServerConfig{BaseUrl: backend.URL, Auth: auth,
+			TLS: TLSConfig{CAFile: backendCA, CertFile: certFile, KeyFile: keyFile}}
+		client, err := newServerClient(server, ClientConfig{RetryCount: -1}, nil, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.R().Get(backend.URL)
+		return resp.String(), err
+	}
+	auth := AuthConfig{
+		Type:         AuthOAuth2ClientCredentials,
+		TokenUrl:     tokenServer.URL + "/oauth/token",
+		ClientId:     mockClientId,
+		ClientSecret: mockClientSecret,
+		Scopes:       []string{"tls"},
+	}
+	// The token endpoint is verified with the system roots, not the CA of the backend
+	_, err := get(auth)
+	assert.ErrorContains(t, err, "certificate")
+
+	auth.TLS = TLSConfig{CAFile: tokenCA}
+	authorization, err := get(auth)
+	assert.NoError(t, err)
+	assert.Regexp(t, "^Bearer mock-token-", authorization)
+	assert.Equal(t, int32(0), clientCertificates.Load())
+}
+
+func TestOAuth2TokenSingleFetch(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		oauthToken(w, r)
+	}))
+	defer tokenServer.Close()
+	ts, err := sharedTokenSource(AuthConfig{
+		Type:         AuthOAuth2ClientCredentials,
+		TokenUrl:     tokenServer.URL + "/oauth/token",
+		ClientId:     mockClientId,
+		ClientSecret: mockClientSecret,
+		Scopes:       []string{"single-fetch"},
+	})
+	assert.NoError(t, err)
+
+	// The request fetching the token is cancelled while others wait for it
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := ts.token(first)
+		firstErr <- err
+	}()
+	assert.Eventually(t, func() bool { return requests.Load() == 1 }, time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := ts.token(context.Background())
+			assert.NoError(t, err)
+			tokens[i] = token
+		}(i)
+	}
+	// Waiting requests honour their own context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ts.token(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	cancelFirst()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+	// One of the waiting requests fetches the token instead
+	assert.Eventually(t, func() bool { return requests.Load() == 2 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, token := range tokens {
+		assert.Equal(t, tokens[0], token)
+	}
+	assert.Equal(t, int32(2), requests.Load())
+}
@@ -0,0 +1,270 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.temporal.io/sdk/client"
+)
+
+// States of a circuit breaker
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// Defaults of the circuit breakers
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+	defaultHalfOpenRequests = 1
+)
+
+// Metrics of the circuit breakers, tagged with the host
+const (
+	circuitStateGauge      = "cas_circuit_breaker_state"
+	circuitRejectedCounter = "cas_circuit_breaker_rejected_requests"
+	circuitOpenedCounter   = "cas_circuit_breaker_opened"
+	circuitHostTag         = "host"
+)
+
+// Values of the state gauge of the circuit breakers
+const (
+	circuitClosedValue = iota
+	circuitHalfOpenValue
+	circuitOpenValue
+)
+
+// CircuitBreakerConfig configures the circuit breaker of the requests of the worker to a host.
+// The circuit opens after FailureThreshold consecutive failures (5 by default, negative
+// disables the breaker), where failures are requests failing without a response or with a
+// server error. While it is open, requests fail right away with an OpenCircuitError. After
+// OpenTimeout (30s by default) the circuit is half open and lets HalfOpenRequests requests
+// through (1 by default): it closes if they succeed and opens again if one fails.
+type CircuitBreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// merge returns the configuration with the settings of override that are set
+func (c CircuitBreakerConfig) merge(override CircuitBreakerConfig) CircuitBreakerConfig {
+	if override.FailureThreshold != 0 {
+		c.FailureThreshold = override.FailureThreshold
+	}
+	if override.OpenTimeout != 0 {
+		c.OpenTimeout = override.OpenTimeout
+	}
+	if override.HalfOpenRequests != 0 {
+		c.HalfOpenRequests = override.HalfOpenRequests
+	}
+	return c
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultFailureThreshold
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = defaultOpenTimeout
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	return c
+}
+
+// OpenCircuitError fails a request to a host whose circuit is open. Its activity fails with a
+// retryable CircuitOpenError, which the workflow retries once the circuit is half open, after
+// RetryAfter.
+type OpenCircuitError struct {
+	Method     string
+	Url        string
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenCircuitError) Error() string {
+	return fmt.Sprintf("%s %s: circuit of %s is open, retry after %s", e.Method, e.Url, e.Host, e.RetryAfter)
+}
+
+// CircuitStatus is the state of the circuit breaker of a host, as reported by the debug
+// handler of the worker.
+type CircuitStatus struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	Rejected            int64      `json:"rejected"`
+}
+
+// circuitBreaker is the circuit breaker of a host, shared by all clients of the worker sending
+// requests to the host.
+type circuitBreaker struct {
+	host    string
+	config  CircuitBreakerConfig
+	metrics client.MetricsHandler
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	// trials are the requests let through while the circuit is half open
+	trials    int
+	succeeded int
+	rejected  int64
+}
+
+func newCircuitBreaker(host string, config CircuitBreakerConfig, metrics client.MetricsHandler) *circuitBreaker {
+	b := &circuitBreaker{
+		host:    host,
+		config:  config.withDefaults(),
+		metrics: metrics.WithTags(map[string]string{circuitHostTag: host}),
+		state:   CircuitClosed,
+	}
+	b.metrics.Gauge(circuitStateGauge).Update(circuitClosedValue)
+	return b
+}
+
+// allow tells whether a request can be sent, or how long the circuit stays open otherwise
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen {
+		if wait := b.config.OpenTimeout - time.Since(b.openedAt); wait > 0 {
+			return b.reject(wait)
+		}
+		b.setState(CircuitHalfOpen)
+		b.trials, b.succeeded = 0, 0
+	}
+	if b.state == CircuitHalfOpen {
+		if b.trials >= b.config.HalfOpenRequests {
+			return b.reject(b.config.OpenTimeout)
+		}
+		b.trials++
+	}
+	return 0, true
+}
+
+// reject counts a rejected request. b.mu must be held.
+func (b *circuitBreaker) reject(retryAfter time.Duration) (time.Duration, bool) {
+	b.rejected++
+	b.metrics.Counter(circuitRejectedCounter).Inc(1)
+	return retryAfter, false
+}
+
+// release gives back the permission of a request which allow let through, but which was not
+// sent or whose outcome tells nothing about the host
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// record records the outcome of a request which allow let through
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case failed && b.state == CircuitHalfOpen:
+		b.open()
+	case failed:
+		b.failures++
+		if b.state == CircuitClosed && b.failures >= b.config.FailureThreshold {
+			b.open()
+		}
+	case b.state == CircuitHalfOpen:
+		b.succeeded++
+		if b.succeeded >= b.config.HalfOpenRequests {
+			b.failures = 0
+			b.setState(CircuitClosed)
+		}
+	default:
+		b.failures = 0
+	}
+}
+
+// open opens the circuit. b.mu must be held.
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.setState(CircuitOpen)
+	b.metrics.Counter(circuitOpenedCounter).Inc(1)
+}
+
+// setState changes the state of the circuit. b.mu must be held.
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	value := circuitClosedValue
+	switch state {
+	case CircuitHalfOpen:
+		value = circuitHalfOpenValue
+	case CircuitOpen:
+		value = circuitOpenValue
+	}
+	b.metrics.Gauge(circuitStateGauge).Update(float64(value))
+}
+
+func (b *circuitBreaker) status() CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := CircuitStatus{
+		Host:                b.host,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Rejected:            b.rejected,
+	}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// circuitBreakerTransport sends requests through the circuit breaker of their host
+type circuitBreakerTransport struct {
+	base    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (t *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retryAfter, ok := t.breaker.allow()
+	if !ok {
+		return nil, &OpenCircuitError{Method: req.Method, Url: req.URL.String(), Host: t.breaker.host,
+			RetryAfter: retryAfter}
+	}
+	resp, err := t.base.RoundTrip(req)
+	// Requests cancelled by their activity and requests held back by the rate limit of the
+	// worker tell nothing about the host
+	var retryLater *RetryLaterError
+	if errors.As(err, &retryLater) || errors.Is(req.Context().Err(), context.Canceled) {
+		t.breaker.release()
+		return resp, err
+	}
+	t.breaker.record(err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// DebugHandler serves the states of the circuit breakers of the worker as JSON, e.g. on
+// /debug/circuits of the debug server of the worker.
+func (f *ClientFactory) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		circuits := []CircuitStatus{}
+		for _, breaker := range f.breakers {
+			circuits = append(circuits, breaker.status())
+		}
+		f.mu.Unlock()
+		sort.Slice(circuits, func(i, j int) bool { return circuits[i].Host < circuits[j].Host })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"circuits": circuits})
+	})
+}
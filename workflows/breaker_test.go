@@ -0,0 +1,152 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/client"
+	"go.temporal.io/sdk/temporal"
+)
+
+// gaugeRecorder is a metrics handler recording the last values of gauges
+type gaugeRecorder struct {
+	mu     *sync.Mutex
+	tags   map[string]string
+	gauges map[string]float64
+}
+
+func newGaugeRecorder() *gaugeRecorder {
+	return &gaugeRecorder{mu: &sync.Mutex{}, gauges: map[string]float64{}}
+}
+
+func (h *gaugeRecorder) WithTags(tags map[string]string) client.MetricsHandler {
+	return &gaugeRecorder{mu: h.mu, tags: tags, gauges: h.gauges}
+}
+
+func (h *gaugeRecorder) Counter(string) client.MetricsCounter {
+	return client.MetricsNopHandler.Counter("")
+}
+
+func (h *gaugeRecorder) Gauge(name string) client.MetricsGauge {
+	return gaugeFunc(func(v float64) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.gauges[name+","+h.tags[circuitHostTag]] = v
+	})
+}
+
+func (h *gaugeRecorder) Timer(string) client.MetricsTimer {
+	return client.MetricsNopHandler.Timer("")
+}
+
+func (h *gaugeRecorder) gauge(name string, host string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.gauges[name+","+host]
+}
+
+type gaugeFunc func(float64)
+
+func (f gaugeFunc) Update(v float64) { f(v) }
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "converter down", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  default:
+    base_url: ` + server.URL + `
+    circuit_breaker:
+      failure_threshold: 2
+      open_timeout: 200ms
+client:
+  retry_count: -1
+  circuit_breaker:
+    failure_threshold: 10
+`))
+	assert.NoError(t, err)
+	activities := NewActivities(cfg)
+	metrics := newGaugeRecorder()
+	activities.Clients.SetMetricsHandler(metrics)
+	server0, err := activities.Clients.Server(&Activity{})
+	assert.NoError(t, err)
+	c, err := activities.Clients.Client(server0)
+	assert.NoError(t, err)
+	host := hostOf(server.URL)
+
+	for i := 0; i < 2; i++ {
+		resp, err := c.R().Get(server.URL + "/media_stream_to_abr_converter/1")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode())
+	}
+	assert.Equal(t, float64(circuitOpenValue), metrics.gauge(circuitStateGauge, host))
+
+	// The open circuit fails requests without sending them
+	_, err = getResource(context.Background(), c, server.URL+"/media_stream_to_abr_converter/1")
+	var openCircuit *OpenCircuitError
+	assert.ErrorAs(t, err, &openCircuit)
+	assert.Equal(t, int32(2), requests.Load())
+	err = httpActivityError(context.Background(), "mstabr", "GetResourceError", err, nil)
+	var appErr *temporal.ApplicationError
+	if assert.True(t, errors.As(err, &appErr)) {
+		assert.Equal(t, CircuitOpenError, appErr.Type())
+		assert.False(t, appErr.NonRetryable())
+		assert.Greater(t, appErr.NextRetryDelay(), time.Duration(0))
+		assert.LessOrEqual(t, appErr.NextRetryDelay(), 200*time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	activities.Clients.DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/circuits", nil))
+	var debug struct {
+		Circuits []CircuitStatus `json:"circuits"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &debug))
+	if assert.Len(t, debug.Circuits, 1) {
+		assert.Equal(t, host, debug.Circuits[0].Host)
+		assert.Equal(t, CircuitOpen, debug.Circuits[0].State)
+		assert.Equal(t, int64(1), debug.Circuits[0].Rejected)
+		assert.NotNil(t, debug.Circuits[0].OpenedAt)
+	}
+
+	// A failing trial request opens the circuit again, a successful one closes it
+	time.Sleep(250 * time.Millisecond)
+	_, err = c.R().Get(server.URL)
+	assert.NoError(t, err)
+	_, err = c.R().Get(server.URL)
+	assert.ErrorAs(t, err, &openCircuit)
+	time.Sleep(250 * time.Millisecond)
+	healthy.Store(true)
+	resp, err := c.R().Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, float64(circuitClosedValue), metrics.gauge(circuitStateGauge, host))
+	assert.Equal(t, int32(4), requests.Load())
+
+	// The breaker can be disabled
+	disabled := NewClientFactory(&WorkerConfig{Client: ClientConfig{RetryCount: -1,
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: -1}}})
+	healthy.Store(false)
+	c, err = disabled.Client(ServerConfig{BaseUrl: server.URL})
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := c.R().Get(server.URL)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(14), requests.Load())
+}
@@ -0,0 +1,257 @@
+package workflows
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	sdkclient "go.temporal.io/sdk/client"
+	"golang.org/x/time/rate"
+)
+
+// Defaults of the HTTP clients of the worker
+const (
+	defaultRetryCount          = 5
+	defaultRetryWaitTime       = time.Second
+	defaultRetryMaxWaitTime    = 20 * time.Second
+	defaultRequestTimeout      = 30 * time.Second
+	defaultMaxIdleConnsPerHost = 16
+)
+
+// ClientConfig configures the HTTP clients of the worker. Failed requests are retried
+// RetryCount times (a negative count disables retries), waiting from RetryWaitTime up to
+// RetryMaxWaitTime between attempts. RetryableStatus overrides whether an activity failing with
+// a status code is retried by the workflow, see statusRetryable.
+type ClientConfig struct {
+	RetryCount          int           `yaml:"retry_count"`
+	RetryWaitTime       time.Duration `yaml:"retry_wait_time"`
+	RetryMaxWaitTime    time.Duration `yaml:"retry_max_wait_time"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	RetryableStatus     map[int]bool  `yaml:"retryable_status"`
+	// CircuitBreaker configures the circuit breakers of the hosts of the servers
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+func (c ClientConfig) withDefaults() ClientConfig {
+	if c.RetryCount == 0 {
+		c.RetryCount = defaultRetryCount
+	}
+	if c.RetryCount < 0 {
+		c.RetryCount = 0
+	}
+	if c.RetryWaitTime <= 0 {
+		c.RetryWaitTime = defaultRetryWaitTime
+	}
+	if c.RetryMaxWaitTime <= 0 {
+		c.RetryMaxWaitTime = defaultRetryMaxWaitTime
+	}
+	if c.MaxIdleConnsPerHost <= 0 {
+		c.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	return c
+}
+
+// newServerClient creates a client for the requests to a server. It sends the default headers
+// of the server and the identity headers of activities, records the transcripts of activities,
+// authenticates the requests, applies its TLS configuration, request timeout, rate limit and
+// circuit breaker, and retries failed requests, honouring the Retry-After of responses.
+func newServerClient(server ServerConfig, cfg ClientConfig, limiter *rate.Limiter,
+	breaker *circuitBreaker) (*resty.Client, error) {
+	cfg = cfg.withDefaults()
+	tlsConfig, err := server.TLS.clientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	timeout := server.Timeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	roundTripper, err := newAuthTransport(transport, server.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	if limiter != nil {
+		roundTripper = &rateLimitTransport{base: roundTripper, limiter: limiter}
+	}
+	if breaker != nil {
+		roundTripper = &circuitBreakerTransport{base: roundTripper, breaker: breaker}
+	}
+	roundTripper = newIdentityTransport(&transcriptTransport{base: roundTripper}, server.IdentityHeaders)
+	client := resty.New().
+		SetRetryCount(cfg.RetryCount).
+		SetRetryWaitTime(cfg.RetryWaitTime).
+		SetRetryMaxWaitTime(cfg.RetryMaxWaitTime).
+		AddRetryCondition(retryCondition).
+		SetRetryAfter(retryAfterFunc(cfg.RetryMaxWaitTime)).
+		SetHeaders(server.Headers).
+		SetTransport(roundTripper).
+		SetTimeout(timeout)
+	return client, nil
+}
+
+// ClientFactory creates the HTTP clients of a worker. A client is created once per server and
+// shared by all activities sending requests to it, so that connections and tokens are reused.
+// The rate limits and circuit breakers of the servers are kept per host, see RateLimitConfig
+// and CircuitBreakerConfig. Requests are bound to the context of the activity, see Activities.
+type ClientFactory struct {
+	config  *WorkerConfig
+	metrics sdkclient.MetricsHandler
+
+	mu       sync.Mutex
+	clients  map[string]*resty.Client
+	limiters map[string]*rate.Limiter
+	breakers map[string]*circuitBreaker
+	// grpcClients are the connections to the gRPC servers, see GrpcCallActivity
+	grpcClients map[string]*grpcClient
+}
+
+func NewClientFactory(cfg *WorkerConfig) *ClientFactory {
+	if cfg == nil {
+		cfg = &WorkerConfig{}
+	}
+	return &ClientFactory{
+		config:      cfg,
+		metrics:     sdkclient.MetricsNopHandler,
+		clients:     map[string]*resty.Client{},
+		limiters:    map[string]*rate.Limiter{},
+		breakers:    map[string]*circuitBreaker{},
+		grpcClients: map[string]*grpcClient{},
+	}
+}
+
+// SetMetricsHandler sets the handler of the metrics of the circuit breakers, usually the one of
+// the Temporal client of the worker. It must be set before activities run.
+func (f *ClientFactory) SetMetricsHandler(handler sdkclient.MetricsHandler) {
+	f.metrics = handler
+}
+
+// Server returns the server of the activity, as declared in the workflow or configured in the
+// worker.
+func (f *ClientFactory) Server(activity *Activity) (ServerConfig, error) {
+	if activity.ServerConfig != nil {
+		return f.declaredServer(activity.Name, *activity.ServerConfig)
+	}
+	server, ok := f.config.Servers[activity.serverName()]
+	if !ok {
+		return ServerConfig{}, newUnknownServerError(activity.Name, activity.serverName())
+	}
+	return server, nil
+}
+
+// declaredServer checks a server declared by the workflow of an activity and completes it with
+// the auth and TLS settings of the server of the worker its Credentials name, if that server
+// lends them to the host of the declared server, see lendsCredentials. Workflows are
+// checked by ValidateWorkflow when they are started, this check is repeated by the worker as it
+// runs the activities.
+func (f *ClientFactory) declaredServer(activityName string, server ServerConfig) (ServerConfig, error) {
+	err := server.validateDeclared()
+	if err != nil {
+		return ServerConfig{}, newInvalidServerError(activityName, err)
+	}
+	if server.Credentials != "" {
+		credentials, ok := f.config.Servers[server.Credentials]
+		if !ok {
+			return ServerConfig{}, newUnknownServerError(activityName, server.Credentials)
+		}
+		err = credentials.lendsCredentials(server.Credentials, server.BaseUrl)
+		if err != nil {
+			return ServerConfig{}, newInvalidServerError(activityName, err)
+		}
+		server.Auth = credentials.Auth
+		server.TLS = credentials.TLS
+	}
+	return server, nil
+}
+
+// Client returns the client for the requests to a server
+func (f *ClientFactory) Client(server ServerConfig) (*resty.Client, error) {
+	// Servers declared by workflows have no name, the client is looked up by configuration
+	key, err := json.Marshal(server)
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	client, ok := f.clients[string(key)]
+	if ok {
+		return client, nil
+	}
+	client, err = newServerClient(server, f.config.Client, f.limiter(server), f.breaker(server))
+	if err != nil {
+		return nil, err
+	}
+	f.clients[string(key)] = client
+	return client, nil
+}
+
+// limiter returns the rate limiter of the host of a server, or nil if the requests to the host
+// are not limited. f.mu must be held.
+func (f *ClientFactory) limiter(server ServerConfig) *rate.Limiter {
+	host := hostOf(server.BaseUrl)
+	limiter, ok := f.limiters[host]
+	if ok {
+		return limiter
+	}
+	limit := f.hostRateLimit(host, server)
+	if limit.Rate > 0 {
+		limiter = limit.limiter()
+	}
+	f.limiters[host] = limiter
+	return limiter
+}
+
+// hostRateLimit returns the rate limit of a host: the one of the first server of the worker on
+// the host, by name, which has one, so that it does not depend on which server is used first.
+// Servers declared by workflows have no limit and get the one of their host, see
+// validateDeclared.
+func (f *ClientFactory) hostRateLimit(host string, server ServerConfig) RateLimitConfig {
+	names := make([]string, 0, len(f.config.Servers))
+	for name := range f.config.Servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		configured := f.config.Servers[name]
+		if configured.RateLimit.Rate > 0 && hostOf(configured.BaseUrl) == host {
+			return configured.RateLimit
+		}
+	}
+	return server.RateLimit
+}
+
+// breaker returns the circuit breaker of the host of a server, or nil if the breaker is
+// disabled. f.mu must be held.
+func (f *ClientFactory) breaker(server ServerConfig) *circuitBreaker {
+	host := hostOf(server.BaseUrl)
+	breaker, ok := f.breakers[host]
+	if ok {
+		return breaker
+	}
+	cfg := f.config.Client.CircuitBreaker.merge(server.CircuitBreaker)
+	if cfg.FailureThreshold < 0 {
+		return nil
+	}
+	breaker = newCircuitBreaker(host, cfg, f.metrics)
+	f.breakers[host] = breaker
+	return breaker
+}
+
+// retryableStatus returns the status codes whose retryability the worker or the server
+// overrides, the server taking precedence.
+func (f *ClientFactory) retryableStatus(server ServerConfig) map[int]bool {
+	retryable := map[int]bool{}
+	for code, r := range f.config.Client.RetryableStatus {
+		retryable[code] = r
+	}
+	for code, r := range server.RetryableStatus {
+		retryable[code] = r
+	}
+	return retryable
+}
@@ -0,0 +1,209 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func TestClientFactory(t *testing.T) {
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  ingest:
+    base_url: http://ingest
+client:
+  retry_count: -1
+  retry_wait_time: 100ms
+  max_idle_conns_per_host: 4
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, ClientConfig{RetryCount: -1, RetryWaitTime: 100 * time.Millisecond, MaxIdleConnsPerHost: 4}, cfg.Client)
+
+	factory := NewClientFactory(cfg)
+	server, err := factory.Server(&Activity{ActivityParams: ActivityParams{Name: "live_hooks", Server: "ingest"}})
+	assert.NoError(t, err)
+	client, err := factory.Client(server)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, client.RetryCount)
+	assert.Equal(t, defaultRequestTimeout, client.GetClient().Timeout)
+
+	// Activities share the client of a server
+	same, err := factory.Client(cfg.Servers["ingest"])
+	assert.NoError(t, err)
+	assert.Same(t, client, same)
+	other, err := factory.Client(ServerConfig{BaseUrl: "http://ingest", Timeout: time.Second})
+	assert.NoError(t, err)
+	assert.NotSame(t, client, other)
+	assert.Equal(t, time.Second, other.GetClient().Timeout)
+}
+
+func TestRequestsBoundToActivityContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := getResource(ctx, testClient(t), server.URL)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestCleanupActivity(t *testing.T) {
+	var mu sync.Mutex
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		assert.Equal(t, "media", r.Header.Get("x-tenant"))
+		mu.Lock()
+		deleted = append(deleted, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/live_hooks/gone" {
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL, Headers: map[string]string{"x-tenant": "media"}},
+	}}
+	suite := testsuite.WorkflowTestSuite{}
+	env := suite.NewTestActivityEnvironment()
+	env.RegisterActivity(NewActivities(cfg))
+
+	var activities *Activities
+	val, err := env.ExecuteActivity(activities.CleanupActivity, []CreatedResource{
+		{Url: server.URL + "/live_hooks/1", Server: DefaultServerName},
+		{Url: server.URL + "/live_hooks/gone", Server: DefaultServerName},
+	})
+	assert.NoError(t, err)
+	var result string
+	assert.NoError(t, val.Get(&result))
+	assert.Equal(t, "Success", result)
+	assert.Equal(t, []string{"/live_hooks/1", "/live_hooks/gone"}, deleted)
+}
+
+func TestCleanupDeclaredServer(t *testing.T) {
+	var mu sync.Mutex
+	deleted := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("x-tenant") != "media" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		deleted = append(deleted, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	// The resources are created on a server declared by the workflow, with the credentials of a
+	// server of the worker which lends them to the host of the declared server
+	cfg := &WorkerConfig{Servers: map[string]ServerConfig{"ingest": {
+		BaseUrl:         "http://ingest.example.com",
+		Auth:            AuthConfig{Type: AuthBearer, Token: "secret"},
+		CredentialHosts: []string{hostOf(server.URL)},
+	}}}
+	wf, err := ParseWorkflow([]byte(`
+servers:
+  packaging:
+    base_url: ` + server.URL + `
+    headers:
+      x-tenant: media
+    credentials: ingest
+activities:
+  - name: mstabr
+    server: packaging
+`))
+	assert.NoError(t, err)
+	activityResults := map[string]ActivityResult{
+		"mstabr": {ResourceUrl: server.URL + "/mstabr/1", Server: "packaging"},
+		"script": {Result: map[string]interface{}{"value": 1}},
+	}
+	resources := createdResources(wf, activityResults)
+	assert.Len(t, resources, 1)
+
+	suite := testsuite.WorkflowTestSuite{}
+	env := suite.NewTestActivityEnvironment()
+	env.RegisterActivity(NewActivities(cfg))
+	var activities *Activities
+	_, err = env.ExecuteActivity(activities.CleanupActivity, resources)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DELETE /mstabr/1"}, deleted)
+}
+
+func TestHTTPErrorClassification(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var status int
+		fmt.Sscanf(r.URL.Path, "/status/%d", &status)
+		http.Error(w, `{"error": "status `+strconv.Itoa(status)+`"}`, status)
+	}))
+	defer server.Close()
+
+	cfg := &WorkerConfig{
+		Servers: map[string]ServerConfig{
+			DefaultServerName: {BaseUrl: server.URL, RetryableStatus: map[int]bool{503: false}},
+		},
+		Client: ClientConfig{RetryCount: -1, RetryableStatus: map[int]bool{409: true, 503: true}},
+	}
+	activities := NewActivities(cfg)
+
+	tests := []struct {
+		status    int
+		errType   string
+		retryable bool
+	}{
+		{400, BadRequestError, false},
+		{422, BadRequestError, false},
+		{401, UnauthorizedError, false},
+		{403, UnauthorizedError, false},
+		{404, NotFoundError, false},
+		{409, ConflictError, true},
+		{429, RateLimitedError, true},
+		{500, ServerError, true},
+		{503, ServerError, false},
+	}
+	for _, tt := range tests {
+		activity := Activity{}
+		activity.Name = "live_hooks"
+		activity.RequestParams = RequestParams{Path: fmt.Sprintf("status/%d", tt.status), Method: "POST"}
+		activity.Lookup = LookupParams{Strategy: LookupNone}
+		_, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, WorkflowMetadata{ID: "wf"})
+
+		var appErr *temporal.ApplicationError
+		if !assert.ErrorAs(t, err, &appErr, tt.status) {
+			continue
+		}
+		assert.Equal(t, tt.errType, appErr.Type(), tt.status)
+		assert.Equal(t, !tt.retryable, appErr.NonRetryable(), tt.status)
+		var details HTTPErrorDetails
+		assert.NoError(t, appErr.Details(&details))
+		assert.Equal(t, tt.status, details.StatusCode)
+		assert.Equal(t, http.MethodPost, details.Method)
+		assert.Contains(t, details.Body, fmt.Sprintf("status %d", tt.status))
+	}
+
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST", Body: map[string]interface{}{"x": math.NaN()}}
+	_, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, WorkflowMetadata{ID: "wf"})
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, RequestMarshalError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+}
@@ -0,0 +1,190 @@
+package workflows
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/maja42/goval"
+)
+
+// Condition is a parsed completeness condition like
+//
+//	{{ .result.meta.status }} == 'created' && {{ .result.meta.progress }} >= 100
+//
+// Placeholders refer to the resource being checked with `.result.<path>` and may use the
+// optional and default forms of value expressions; a missing field evaluates to nil, and a
+// condition which fails on the type of a nil field, e.g. comparing it to a number, does not hold
+// yet. They keep
+// their json type, so conditions can compare strings, numbers, booleans, nulls, lists and
+// objects. The expression is evaluated with goval, which supports `&&`, `||`, `!`, comparisons
+// and `in`. Strings can be single or double quoted. On top of that the following functions
+// are available:
+//
+//	len(x)              length of a string, list or object
+//	matches(s, 'regex') whether s matches the regular expression
+type Condition struct {
+	Condition string
+	// expression is the goval expression with placeholders replaced by variables
+	expression string
+	references map[string]*ValueExpression
+}
+
+var conditionFunctions = map[string]goval.ExpressionFunction{
+	"len": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len() expects 1 argument, got %d", len(args))
+		}
+		switch v := args[0].(type) {
+		case string:
+			return len(v), nil
+		case []interface{}:
+			return len(v), nil
+		case map[string]interface{}:
+			return len(v), nil
+		case nil:
+			return 0, nil
+		}
+		return nil, fmt.Errorf("len() is not defined for %T", args[0])
+	},
+	"matches": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("matches() expects 2 arguments, got %d", len(args))
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return false, nil
+		}
+		pattern, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("matches() expects a string pattern, got %T", args[1])
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s), nil
+	},
+}
+
+// ParseCondition parses a condition and checks the resulting expression for syntax errors
+func ParseCondition(condition string) (*Condition, error) {
+	c := Condition{Condition: condition, references: map[string]*ValueExpression{}}
+
+	var sb strings.Builder
+	for i := 0; i < len(condition); {
+		switch ch := condition[i]; {
+		case strings.HasPrefix(condition[i:], "{{"):
+			end := strings.Index(condition[i:], "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("InvalidCondition: unterminated placeholder in %q", condition)
+			}
+			expr, err := ParseValueExpression(condition[i : i+end+2])
+			if err != nil {
+				return nil, fmt.Errorf("InvalidCondition: %w", err)
+			}
+			if expr.Activity != "" || expr.Field != ResultField {
+				return nil, fmt.Errorf("InvalidCondition: %q must refer to .result.<path>", expr.Expression)
+			}
+			name := fmt.Sprintf("__ref%d", len(c.references))
+			c.references[name] = expr
+			sb.WriteString(name)
+			i += end + 2
+		case ch == '\'':
+			// Single quoted string literals are rewritten to double quoted ones for goval
+			end := i + 1
+			for end < len(condition) && condition[end] != '\'' {
+				if condition[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(condition) {
+				return nil, fmt.Errorf("InvalidCondition: unterminated string in %q", condition)
+			}
+			literal := strings.ReplaceAll(condition[i+1:end], `\'`, `'`)
+			sb.WriteString(strconv.Quote(literal))
+			i = end + 1
+		case ch == '"' || ch == '`':
+			end := i + 1
+			for end < len(condition) && condition[end] != ch {
+				if ch == '"' && condition[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(condition) {
+				return nil, fmt.Errorf("InvalidCondition: unterminated string in %q", condition)
+			}
+			sb.WriteString(condition[i : end+1])
+			i = end + 1
+		default:
+			sb.WriteByte(ch)
+			i++
+		}
+	}
+	c.expression = sb.String()
+
+	// Evaluating with every reference set to nil catches most syntax errors up front. Type
+	// errors depend on the actual values and are only reported by Evaluate.
+	variables := map[string]interface{}{}
+	for name := range c.references {
+		variables[name] = nil
+	}
+	_, err := goval.NewEvaluator().Evaluate(c.expression, variables, conditionFunctions)
+	if err != nil {
+		msg := err.Error()
+		if msg == "syntax error" || strings.HasPrefix(msg, "syntax error: unexpected") ||
+			strings.HasPrefix(msg, "syntax error: no such function") || strings.HasPrefix(msg, "var error") {
+			return nil, fmt.Errorf("InvalidCondition: %q: %w", condition, err)
+		}
+	}
+	return &c, nil
+}
+
+// Values returns the values of the fields the condition refers to in the resource, keyed by
+// their value expression.
+func (c *Condition) Values(resource map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, expr := range c.references {
+		values[expr.Expression], _ = expr.Evaluate(resource)
+	}
+	return values
+}
+
+// Evaluate reports whether the condition holds for the resource
+func (c *Condition) Evaluate(resource map[string]interface{}) (bool, error) {
+	variables := map[string]interface{}{}
+	nils := false
+	for name, expr := range c.references {
+		value, err := expr.Evaluate(resource)
+		if err != nil {
+			// Fields which are not there yet are nil
+			value = nil
+		}
+		nils = nils || value == nil
+		variables[name] = value
+	}
+	result, err := goval.NewEvaluator().Evaluate(c.expression, variables, conditionFunctions)
+	if err != nil && nils && isNilTypeError(err) {
+		// goval does not short-circuit && and ||, so a field which is not there yet fails
+		// comparisons whichever other clauses already decide the condition
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("ConditionEvaluationError: %q: %w", c.Condition, err)
+	}
+	resultB, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("ConditionEvaluationError: %q evaluated to %v, not a bool", c.Condition, result)
+	}
+	return resultB, nil
+}
+
+// isNilTypeError tells whether goval failed on the type of a nil operand, like
+// "type error: cannot compare type nil and number"
+func isNilTypeError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "type error") && strings.Contains(msg, "nil")
+}
@@ -0,0 +1,224 @@
+package workflows
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/workflow"
+)
+
+var abrConverterResource = map[string]interface{}{
+	"meta": map[string]interface{}{
+		"status":   "created",
+		"progress": float64(100),
+		"ready":    true,
+		"error":    nil,
+		"tags":     []interface{}{"hls", "live"},
+	},
+	"hls_abr_settings": map[string]interface{}{
+		"variants": []interface{}{
+			map[string]interface{}{"video_width": float64(1920)},
+			map[string]interface{}{"video_width": float64(1280)},
+		},
+	},
+}
+
+func TestConditionEvaluate(t *testing.T) {
+	tests := []struct {
+		condition string
+		expected  bool
+	}{
+		{"{{.result.meta.status}} == 'created'", true},
+		{`{{ .result.meta.status }} == "pending"`, false},
+		{"{{ .result.meta.progress }} >= 100", true},
+		{"{{ .result.meta.progress }} == 100 && {{ .result.meta.ready }}", true},
+		{"!{{ .result.meta.ready }} || {{ .result.meta.progress }} < 50", false},
+		{"{{ .result.meta.error }} == nil", true},
+		{"{{ .result.meta.missing }} == nil", true},
+		{"{{ .result.meta.status }} in ['created', 'ready']", true},
+		{"'live' in {{ .result.meta.tags }}", true},
+		{"len({{ .result.hls_abr_settings.variants }}) == 2", true},
+		{"{{ .result.hls_abr_settings.variants[1].video_width }} == 1280", true},
+		{"matches({{ .result.meta.status }}, '^creat(ed|ing)$')", true},
+		{"{{ .result.meta.label | default 'none' }} == 'none'", true},
+		{"{{ .result.meta.status }} == 'it\\'s'", false},
+		// Fields which are not there yet do not fail the condition
+		{"{{ .result.meta.status }} == 'created' && {{ .result.meta.percent }} >= 100", false},
+		{"{{ .result.meta.missing }} && {{ .result.meta.ready }}", false},
+	}
+	for _, tt := range tests {
+		condition, err := ParseCondition(tt.condition)
+		if !assert.NoError(t, err, tt.condition) {
+			continue
+		}
+		result, err := condition.Evaluate(abrConverterResource)
+		assert.NoError(t, err, tt.condition)
+		assert.Equal(t, tt.expected, result, tt.condition)
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	for _, c := range []string{
+		"{{ .result.meta.status }} ==",
+		"{{ .result.meta.status }} == 'created",
+		"{{ .result.meta.status == 'created'",
+		"{{ live_hooks.result.meta.status }} == 'created'",
+		"unknown({{ .result.meta.status }})",
+		"status == 'created'",
+	} {
+		_, err := ParseCondition(c)
+		assert.Error(t, err, c)
+	}
+
+	for _, c := range []string{
+		"{{ .result.meta.status }} > 1",
+		"{{ .result.meta.progress }}",
+		"{{ .result.meta.missing }}",
+	} {
+		condition, err := ParseCondition(c)
+		assert.NoError(t, err, c)
+		_, err = condition.Evaluate(abrConverterResource)
+		assert.Error(t, err, c)
+	}
+}
+
+func TestWaitForInvalidCondition(t *testing.T) {
+	activity := Activity{}
+	activity.Name = "mstabr"
+	activity.CompletenessCondition = "{{ .result.meta.status }} =="
+	_, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), &activity, "http://localhost:0/unused")
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, InvalidExpressionError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+}
+
+func TestWaitForFailureCondition(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"meta": {"status": "error", "error": {"code": 42, "message": "no input signal"}}}`))
+	}))
+	defer server.Close()
+
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.CompletenessCondition = "{{ .result.meta.status }} == 'created'"
+	activity.FailureCondition = "{{ .result.meta.status }} in ['error', 'failed']"
+	_, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), &activity, server.URL+"/live_hooks/1")
+
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, ResourceFailedError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+	var details ResourceFailedDetails
+	assert.NoError(t, appErr.Details(&details))
+	assert.Equal(t, server.URL+"/live_hooks/1", details.ResourceUrl)
+	assert.Equal(t, "no input signal", details.Resource["meta"].(map[string]interface{})["error"].(map[string]interface{})["message"])
+	assert.Equal(t, server.URL+"/live_hooks/1", failedResourceUrl(err))
+}
+
+func TestWaitForConditionTimeout(t *testing.T) {
+	var polls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.Write([]byte(`{"meta": {"status": "pending", "progress": 40}}`))
+	}))
+	defer server.Close()
+
+	activity := Activity{}
+	activity.Name = "mstabr"
+	activity.CompletenessCondition = "{{ .result.meta.status }} == 'created' && {{ .result.meta.progress }} == 100"
+	activity.Wait = WaitParams{
+		InitialInterval: 10 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     40 * time.Millisecond,
+		Jitter:          0.1,
+		MaxDuration:     200 * time.Millisecond,
+	}
+	start := time.Now()
+	_, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), &activity, server.URL)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Greater(t, polls.Load(), int32(3))
+
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, ConditionTimeoutError, appErr.Type())
+	var details ConditionTimeoutDetails
+	assert.NoError(t, appErr.Details(&details))
+	assert.Equal(t, map[string]interface{}{
+		".result.meta.status":   "pending",
+		".result.meta.progress": float64(40),
+	}, details.LastValues)
+}
+
+func TestWaitForConditionFieldAppears(t *testing.T) {
+	var polls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The progress is only reported once the resource is created
+		if polls.Add(1) < 3 {
+			w.Write([]byte(`{"meta": {"status": "pending"}}`))
+			return
+		}
+		w.Write([]byte(`{"meta": {"status": "created", "progress": 100}}`))
+	}))
+	defer server.Close()
+
+	activity := Activity{}
+	activity.Name = "mstabr"
+	activity.CompletenessCondition = "{{ .result.meta.status }} == 'created' && {{ .result.meta.progress }} >= 100"
+	activity.Wait = WaitParams{InitialInterval: 10 * time.Millisecond, MaxDuration: time.Second}
+	result, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), &activity, server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(100), result["meta"].(map[string]interface{})["progress"])
+	assert.Equal(t, int32(3), polls.Load())
+}
+
+func TestWaitParams(t *testing.T) {
+	wf, err := ParseWorkflow([]byte(`
+activities:
+  - name: live_hooks
+    wait:
+      initial_interval: 2s
+      multiplier: 1.5
+      max_interval: 1m
+      jitter: 0.2
+      max_duration: 10m
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, WaitParams{
+		InitialInterval: 2 * time.Second,
+		Multiplier:      1.5,
+		MaxInterval:     time.Minute,
+		Jitter:          0.2,
+		MaxDuration:     10 * time.Minute,
+	}, wf.Activities[0].Wait)
+
+	// Jittered intervals must not be negative
+	for _, jitter := range []string{"-0.1", "1.5"} {
+		_, err := ParseWorkflow([]byte("activities:\n  - name: live_hooks\n    wait:\n      jitter: " + jitter + "\n"))
+		assert.ErrorContains(t, err, "jitter must be between 0 and 1", jitter)
+	}
+
+	// The activity timeout covers the waits for the operation and the completeness condition
+	options := workflow.ActivityOptions{StartToCloseTimeout: defaultActivityTimeout}
+	activity := &Activity{ActivityParams: wf.Activities[0]}
+	assert.Equal(t, workflow.ActivityOptions{
+		StartToCloseTimeout: defaultActivityTimeout + 20*time.Minute,
+		HeartbeatTimeout:    activityHeartbeatTimeout,
+	}, activityOptions(options, activity))
+	assert.Equal(t, options, activityOptions(options, &Activity{}))
+
+	wait := WaitParams{}.withDefaults()
+	assert.Equal(t, defaultWaitInitialInterval, wait.InitialInterval)
+	assert.Equal(t, wait.InitialInterval, wait.jittered(wait.InitialInterval))
+	wait.Jitter = 0.2
+	for i := 0; i < 10; i++ {
+		d := wait.jittered(10 * time.Second)
+		assert.True(t, d >= 8*time.Second && d <= 12*time.Second, d)
+	}
+}
@@ -0,0 +1,271 @@
+package workflows
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DefaultServerName is the server of activities which do not name one
+const DefaultServerName = "default"
+
+// TLSConfig configures the TLS connections to a server
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the certificate authorities trusted for the server
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM client certificate and key presented for mutual TLS
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// ServerConfig describes a backend server which activities send their requests to. Headers
+// are sent with every request and Timeout bounds every single request.
+type ServerConfig struct {
+	BaseUrl string            `yaml:"base_url"`
+	Headers map[string]string `yaml:"headers"`
+	Auth    AuthConfig        `yaml:"auth"`
+	TLS     TLSConfig         `yaml:"tls"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// Resources are the kinds of resources of the server by request path, see ResourceKind
+	Resources map[string]ResourceKind `yaml:"resources"`
+	// RetryableStatus overrides the one of the worker for the requests to the server
+	RetryableStatus map[int]bool `yaml:"retryable_status"`
+	// RateLimit limits the requests of the worker to the host of the server
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	// CircuitBreaker overrides settings of the circuit breaker of the worker for the host of the
+	// server
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	// IdentityHeaders names the headers identifying the workflow and activity of requests
+	IdentityHeaders IdentityHeaders `yaml:"identity_headers"`
+	// DescriptorSets describe the methods of a gRPC server without server reflection, see
+	// GrpcParams
+	DescriptorSets []string `yaml:"descriptor_sets"`
+	// Credentials names the server of the worker whose Auth and TLS a server declared by a
+	// workflow uses, see declaredServer
+	Credentials string `yaml:"credentials"`
+	// CredentialHosts are the hosts, besides the one of BaseUrl, of the servers declared by
+	// workflows which may use the Auth and TLS of the server through Credentials
+	CredentialHosts []string `yaml:"credential_hosts"`
+}
+
+// WorkerConfig is the configuration of a worker, e.g.
+//
+//	servers:
+//	  ingest:
+//	    base_url: https://ingest.example.com/v1
+//	    timeout: 30s
+//	  packaging:
+//	    base_url: https://packaging.example.com
+//	    headers:
+//	      x-tenant: media
+//	    rate_limit:
+//	      rate: 20
+//	      burst: 40
+//	    auth:
+//	      type: oauth2_client_credentials
+//	      token_url: https://auth.example.com/oauth/token
+//	      client_id: workflows
+//	      client_secret: ${PACKAGING_CLIENT_SECRET}
+//	client:
+//	  retry_count: 3
+//	  retry_max_wait_time: 10s
+//	plugins:
+//	  ladder:
+//	    path: /etc/cas-workflows/plugins/ladder.wasm
+//	    memory_limit_mb: 64
+//
+// Environment variables referenced as ${NAME} are expanded, so that secrets need not be
+// written in the configuration file.
+type WorkerConfig struct {
+	Servers map[string]ServerConfig `yaml:"servers"`
+	Client  ClientConfig            `yaml:"client"`
+	// Transcripts configures the transcripts of the requests of activities
+	Transcripts TranscriptConfig `yaml:"transcripts"`
+	// Plugins are the WebAssembly modules of wasm activities by name, see PluginConfig
+	Plugins map[string]PluginConfig `yaml:"plugins"`
+}
+
+// ParseWorkerConfig parses a yaml worker configuration. If it has no default server and the
+// CAS_SERVER environment variable is set, CAS_SERVER becomes the base url of the default server.
+func ParseWorkerConfig(data []byte) (*WorkerConfig, error) {
+	cfg := WorkerConfig{}
+	err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Servers == nil {
+		cfg.Servers = map[string]ServerConfig{}
+	}
+	if _, ok := cfg.Servers[DefaultServerName]; !ok && os.Getenv("CAS_SERVER") != "" {
+		cfg.Servers[DefaultServerName] = ServerConfig{BaseUrl: os.Getenv("CAS_SERVER")}
+	}
+	for name, server := range cfg.Servers {
+		err := server.validate()
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", name, err)
+		}
+	}
+	for name, plugin := range cfg.Plugins {
+		err := plugin.validate()
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", name, err)
+		}
+	}
+	return &cfg, nil
+}
+
+func LoadWorkerConfig(path string) (*WorkerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWorkerConfig(data)
+}
+
+func (s ServerConfig) validate() error {
+	u, err := url.Parse(s.BaseUrl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https", GrpcScheme, GrpcTLSScheme:
+	default:
+		return fmt.Errorf("base_url %q must be an http, https, grpc or grpcs url", s.BaseUrl)
+	}
+	if (s.TLS.CertFile == "") != (s.TLS.KeyFile == "") {
+		return fmt.Errorf("tls: cert_file and key_file must be set together")
+	}
+	err = s.RateLimit.validate()
+	if err != nil {
+		return err
+	}
+	for path, kind := range s.Resources {
+		err := kind.validate()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return s.Auth.validate()
+}
+
+// validateDeclared checks that a server declared by a workflow holds no secrets, refers to no
+// files of the worker and sets no limits of its host. Workflow specs are recorded in the
+// history of workflows and sent to every activity, and the limits of a host are shared by all
+// the workflows of the worker. Declared servers use the credentials of a server of the worker
+// instead.
+func (s ServerConfig) validateDeclared() error {
+	if s.Auth.Type != "" || s.Auth.Token != "" || s.Auth.Key != "" || s.Auth.ClientSecret != "" {
+		return fmt.Errorf("auth must be configured in the worker, see credentials")
+	}
+	if s.TLS != (TLSConfig{}) {
+		return fmt.Errorf("tls must be configured in the worker, see credentials")
+	}
+	if len(s.DescriptorSets) > 0 {
+		return fmt.Errorf("descriptor_sets must be configured in the worker")
+	}
+	if s.RateLimit != (RateLimitConfig{}) || s.CircuitBreaker != (CircuitBreakerConfig{}) {
+		return fmt.Errorf("rate_limit and circuit_breaker must be configured in the worker")
+	}
+	if len(s.CredentialHosts) > 0 {
+		return fmt.Errorf("credential_hosts must be configured in the worker")
+	}
+	return s.validate()
+}
+
+// lendsCredentials checks that the Auth and TLS of a server of the worker may be used by a
+// server declared by a workflow at baseUrl, otherwise a workflow could send the credentials of
+// the worker to any host. The host of baseUrl must be the one of the server or one of its
+// CredentialHosts.
+func (s ServerConfig) lendsCredentials(name string, baseUrl string) error {
+	host := hostOf(baseUrl)
+	if host != "" && host == hostOf(s.BaseUrl) {
+		return nil
+	}
+	for _, allowed := range s.CredentialHosts {
+		if host != "" && host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("credentials: server %s does not lend its credentials to %s", name, host)
+}
+
+func (t TLSConfig) clientConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// serverName returns the name of the server the activity sends its requests to
+func (a *ActivityParams) serverName() string {
+	if a.Server == "" {
+		return DefaultServerName
+	}
+	return a.Server
+}
+
+// ValidateWorkflow checks that every server referenced by the activities of the workflow is
+// declared in the workflow or configured in the worker, and every plugin is configured in the
+// worker. Declared servers must not hold secrets nor settings of the worker, see
+// validateDeclared.
+func ValidateWorkflow(wf *Workflow, cfg *WorkerConfig) error {
+	for name, server := range wf.Servers {
+		err := server.validateDeclared()
+		if err != nil {
+			return fmt.Errorf("server %s: %w", name, err)
+		}
+		if server.Credentials != "" {
+			credentials, ok := cfg.Servers[server.Credentials]
+			if !ok {
+				return fmt.Errorf("server %s: credentials: server %s is not configured", name, server.Credentials)
+			}
+			err = credentials.lendsCredentials(server.Credentials, server.BaseUrl)
+			if err != nil {
+				return fmt.Errorf("server %s: %w", name, err)
+			}
+		}
+	}
+	for _, activity := range wf.Activities {
+		if activity.Type == Wasm {
+			if _, ok := cfg.Plugins[activity.Wasm.Plugin]; !ok {
+				return fmt.Errorf("activity %s: plugin %s is not configured", activity.Name, activity.Wasm.Plugin)
+			}
+		}
+		if !activity.usesServer() {
+			continue
+		}
+		name := activity.serverName()
+		if _, ok := wf.Servers[name]; ok {
+			continue
+		}
+		if _, ok := cfg.Servers[name]; !ok {
+			return fmt.Errorf("activity %s: server %s is not configured", activity.Name, name)
+		}
+	}
+	return nil
+}
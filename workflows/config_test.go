@@ -0,0 +1,151 @@
+package workflows
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func testClient(t *testing.T) *resty.Client {
+	client, err := NewClientFactory(nil).Client(ServerConfig{})
+	assert.NoError(t, err)
+	return client
+}
+
+func TestParseWorkerConfig(t *testing.T) {
+	os.Setenv("CAS_SERVER", "http://localhost:9200")
+	defer os.Unsetenv("CAS_SERVER")
+
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  ingest:
+    base_url: https://ingest.example.com/v1
+    timeout: 30s
+    headers:
+      x-tenant: media
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, ServerConfig{
+		BaseUrl: "https://ingest.example.com/v1",
+		Headers: map[string]string{"x-tenant": "media"},
+		Timeout: 30 * time.Second,
+	}, cfg.Servers["ingest"])
+	assert.Equal(t, "http://localhost:9200", cfg.Servers[DefaultServerName].BaseUrl)
+
+	_, err = ParseWorkerConfig([]byte("servers:\n  ingest:\n    base_url: ingest.example.com\n"))
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "worker.yaml")
+	os.WriteFile(path, []byte("servers:\n  default:\n    base_url: http://cas:9200\n"), 0o644)
+	cfg, err = LoadWorkerConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://cas:9200", cfg.Servers[DefaultServerName].BaseUrl)
+}
+
+func TestValidateWorkflow(t *testing.T) {
+	cfg := &WorkerConfig{Servers: map[string]ServerConfig{"ingest": {BaseUrl: "http://ingest"}}}
+	wf, err := ParseWorkflow([]byte(`
+servers:
+  packaging:
+    base_url: http://packaging
+activities:
+  - name: live_hooks
+    server: ingest
+  - name: mstabr
+    server: packaging
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, ValidateWorkflow(wf, cfg))
+
+	wfCtxt := CreateWorkflowCtxt(wf)
+	assert.Nil(t, GetActivityFromID(wfCtxt.ActivityDag, "live_hooks").ServerConfig)
+	assert.Equal(t, "http://packaging", GetActivityFromID(wfCtxt.ActivityDag, "mstabr").ServerConfig.BaseUrl)
+
+	wf.Activities = append(wf.Activities, ActivityParams{Name: "cdn", Server: "cdn"})
+	assert.EqualError(t, ValidateWorkflow(wf, cfg), "activity cdn: server cdn is not configured")
+
+	_, err = NewClientFactory(cfg).Server(&Activity{ActivityParams: ActivityParams{Name: "cdn", Server: "cdn"}})
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, UnknownServerError, appErr.Type())
+}
+
+func TestDeclaredServerCredentials(t *testing.T) {
+	cfg := &WorkerConfig{Servers: map[string]ServerConfig{"ingest": {
+		BaseUrl:         "https://ingest",
+		Auth:            AuthConfig{Type: AuthBearer, Token: "secret"},
+		TLS:             TLSConfig{ServerName: "ingest.internal"},
+		CredentialHosts: []string{"ingest-eu"},
+	}}}
+	declare := func(baseUrl string) *Workflow {
+		t.Helper()
+		wf, err := ParseWorkflow([]byte(`
+servers:
+  packaging:
+    base_url: ` + baseUrl + `
+    credentials: ingest
+activities:
+  - name: mstabr
+    server: packaging
+`))
+		assert.NoError(t, err)
+		return wf
+	}
+	wf := declare("https://ingest/v2")
+	assert.NoError(t, ValidateWorkflow(wf, cfg))
+	assert.ErrorContains(t, ValidateWorkflow(wf, &WorkerConfig{}), "credentials: server ingest is not configured")
+
+	// The secrets of the worker are resolved by the worker, they are not part of the workflow
+	for _, baseUrl := range []string{"https://ingest/v2", "https://ingest-eu/v2"} {
+		wf := declare(baseUrl)
+		assert.NoError(t, ValidateWorkflow(wf, cfg), baseUrl)
+		activity := GetActivityFromID(CreateWorkflowCtxt(wf).ActivityDag, "mstabr")
+		assert.Equal(t, AuthConfig{}, activity.ServerConfig.Auth)
+		server, err := NewClientFactory(cfg).Server(activity)
+		assert.NoError(t, err, baseUrl)
+		assert.Equal(t, baseUrl, server.BaseUrl)
+		assert.Equal(t, cfg.Servers["ingest"].Auth, server.Auth)
+		assert.Equal(t, cfg.Servers["ingest"].TLS, server.TLS)
+	}
+
+	// The credentials of a server are not sent to other hosts
+	for _, baseUrl := range []string{"https://packaging", "https://ingest:8443"} {
+		wf := declare(baseUrl)
+		assert.ErrorContains(t, ValidateWorkflow(wf, cfg), "server ingest does not lend its credentials", baseUrl)
+		_, err := NewClientFactory(cfg).Server(GetActivityFromID(CreateWorkflowCtxt(wf).ActivityDag, "mstabr"))
+		var appErr *temporal.ApplicationError
+		if assert.ErrorAs(t, err, &appErr, baseUrl) {
+			assert.Equal(t, InvalidServerError, appErr.Type())
+			assert.True(t, appErr.NonRetryable())
+		}
+	}
+
+	for _, c := range []string{
+		"auth: {type: bearer, token: secret}",
+		"auth: {client_secret: secret}",
+		"tls: {ca_file: /etc/ssl/ca.pem}",
+		"descriptor_sets: [/etc/passwd]",
+		"rate_limit: {rate: 1000}",
+		"circuit_breaker: {failure_threshold: 1000}",
+		"credential_hosts: [packaging]",
+	} {
+		wf, err := ParseWorkflow([]byte("servers:\n  packaging:\n    base_url: https://packaging\n    " + c +
+			"\nactivities:\n  - name: mstabr\n    server: packaging\n"))
+		if !assert.NoError(t, err, c) {
+			continue
+		}
+		assert.Error(t, ValidateWorkflow(wf, cfg), c)
+		// Workflows which were not validated are rejected by the worker
+		_, err = NewClientFactory(cfg).Server(GetActivityFromID(CreateWorkflowCtxt(wf).ActivityDag, "mstabr"))
+		var appErr *temporal.ApplicationError
+		if assert.ErrorAs(t, err, &appErr, c) {
+			assert.Equal(t, InvalidServerError, appErr.Type())
+			assert.True(t, appErr.NonRetryable())
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"go.temporal.io/sdk/temporal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Types of the temporal application errors returned by activities. Application errors must be
+// returned from an activity without wrapping, otherwise the workflow sees neither their type
+// nor whether they are retryable.
+const (
+	UnresolvedExpressionError = "UnresolvedExpressionError"
+	InvalidExpressionError    = "InvalidExpressionError"
+	ConditionEvaluationError  = "ConditionEvaluationError"
+	ResourceFailedError       = "ResourceFailedError"
+	ConditionTimeoutError     = "ConditionTimeoutError"
+	UnknownServerError        = "UnknownServerError"
+	InvalidServerError        = "InvalidServerError"
+	ResourceIdMissingError    = "ResourceIdMissingError"
+	OperationFailedError      = "OperationFailedError"
+	RequestMarshalError       = "RequestMarshalError"
+	CircuitOpenError          = "CircuitOpenError"
+	UnknownMethodError        = "UnknownMethodError"
+	GraphQLError              = "GraphQLError"
+	InvalidScriptError        = "InvalidScriptError"
+	ScriptError               = "ScriptError"
+	UnknownPluginError        = "UnknownPluginError"
+	PluginError               = "PluginError"
+	RequestError              = "RequestError"
+)
+
+// Types of the application errors of HTTP requests which failed with an unexpected status,
+// see statusErrorType
+const (
+	BadRequestError   = "BadRequestError"
+	UnauthorizedError = "UnauthorizedError"
+	NotFoundError     = "NotFoundError"
+	ConflictError     = "ConflictError"
+	RateLimitedError  = "RateLimitedError"
+	ServerError       = "ServerError"
+)
+
+// activityError adds context to err, unless err is a temporal application error which has to
+// reach the workflow as is.
+func activityError(msg string, err error) error {
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// StatusError is an unexpected response to an HTTP request of an activity. It is turned into an
+// application error when the activity returns, see httpActivityError.
+type StatusError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Body       []byte
+	// RetryAfter is the delay the response asks for in its Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *resty.Response) *StatusError {
+	delay, _ := retryAfter(resp.Header())
+	if delay < 0 {
+		delay = 0
+	}
+	return &StatusError{
+		Method:     resp.Request.Method,
+		Url:        resp.Request.URL,
+		StatusCode: resp.StatusCode(),
+		Body:       resp.Body(),
+		RetryAfter: delay,
+	}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %d: %s", e.Method, e.Url, e.StatusCode, excerpt(e.Body))
+}
+
+// statusErrorType returns the type of the application error of a status code
+func statusErrorType(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return UnauthorizedError
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return NotFoundError
+	case statusCode == http.StatusConflict || statusCode == http.StatusPreconditionFailed:
+		return ConflictError
+	case statusCode == http.StatusTooManyRequests:
+		return RateLimitedError
+	case statusCode == http.StatusRequestTimeout || statusCode >= 500:
+		return ServerError
+	default:
+		return BadRequestError
+	}
+}
+
+// statusRetryable tells whether a request which failed with a status code is retried. Rate
+// limited requests, timeouts and server errors are retried by default; retryable overrides
+// the default for single status codes.
+func statusRetryable(statusCode int, retryable map[int]bool) bool {
+	if r, ok := retryable[statusCode]; ok {
+		return r
+	}
+	switch statusErrorType(statusCode) {
+	case RateLimitedError, ServerError:
+		return true
+	}
+	return false
+}
+
+// HTTPErrorDetails are attached to the application errors of failed HTTP requests. Body is the
+// beginning of the response and Transcript the requests of the activity attempt, if recorded.
+type HTTPErrorDetails struct {
+	Activity   string
+	Method     string
+	Url        string
+	StatusCode int
+	Body       string
+	Transcript *Transcript `json:",omitempty"`
+}
+
+// httpActivityError is activityError for activities sending HTTP requests. A StatusError in
+// err becomes an application error typed by its status code, see statusErrorType and
+// statusRetryable. A RetryLaterError becomes a RateLimitedError and an OpenCircuitError a
+// CircuitOpenError. The workflow retries them after the delay the backend asked for in
+// Retry-After, or after the circuit of the host stops being open. Other errors, e.g. requests
+// which failed without a response, become retryable RequestErrors. All of them carry the
+// transcript of the attempt, like the application errors built while it ran.
+func httpActivityError(ctx context.Context, activityName string, msg string, err error, retryable map[int]bool) error {
+	var statusErr *StatusError
+	var retryLater *RetryLaterError
+	var openCircuit *OpenCircuitError
+	var appErr *temporal.ApplicationError
+	if errors.As(err, &appErr) {
+		return activityError(msg, err)
+	}
+	message := fmt.Sprintf("activity %s: %s", activityName, err)
+	var details HTTPErrorDetails
+	var errType string
+	var nextRetryDelay time.Duration
+	switch {
+	case errors.As(err, &openCircuit):
+		details = HTTPErrorDetails{Activity: activityName, Method: openCircuit.Method, Url: openCircuit.Url}
+		errType, nextRetryDelay = CircuitOpenError, openCircuit.RetryAfter
+	case errors.As(err, &retryLater):
+		details = HTTPErrorDetails{
+			Activity:   activityName,
+			Method:     retryLater.Method,
+			Url:        retryLater.Url,
+			StatusCode: retryLater.StatusCode,
+			Body:       excerpt(retryLater.Body),
+		}
+		errType, nextRetryDelay = RateLimitedError, retryLater.Delay
+	case errors.As(err, &statusErr):
+		details = HTTPErrorDetails{
+			Activity:   activityName,
+			Method:     statusErr.Method,
+			Url:        statusErr.Url,
+			StatusCode: statusErr.StatusCode,
+			Body:       excerpt(statusErr.Body),
+		}
+		errType, nextRetryDelay = statusErrorType(statusErr.StatusCode), statusErr.RetryAfter
+	case ctx.Err() != nil:
+		return activityError(msg, err)
+	default:
+		// The request failed without a response, e.g. the connection was refused or timed out
+		return temporal.NewApplicationErrorWithOptions(fmt.Sprintf("%s: %s", msg, err), RequestError,
+			temporal.ApplicationErrorOptions{
+				Cause:   err,
+				Details: []interface{}{HTTPErrorDetails{Activity: activityName, Transcript: transcriptOf(ctx)}},
+			})
+	}
+	details.Transcript = transcriptOf(ctx)
+	if details.StatusCode != 0 && !statusRetryable(details.StatusCode, retryable) {
+		return temporal.NewNonRetryableApplicationError(message, errType, err, details)
+	}
+	return temporal.NewApplicationErrorWithOptions(message, errType, temporal.ApplicationErrorOptions{
+		Cause:          err,
+		Details:        []interface{}{details},
+		NextRetryDelay: nextRetryDelay,
+	})
+}
+
+// grpcErrorType returns the type of the application error of a gRPC status code, the one of
+// the corresponding HTTP status
+func grpcErrorType(code codes.Code) string {
+	switch code {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return UnauthorizedError
+	case codes.NotFound:
+		return NotFoundError
+	case codes.AlreadyExists, codes.Aborted:
+		return ConflictError
+	case codes.ResourceExhausted:
+		return RateLimitedError
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss:
+		return ServerError
+	default:
+		return BadRequestError
+	}
+}
+
+// GrpcErrorDetails are attached to the application errors of failed gRPC calls
+type GrpcErrorDetails struct {
+	Activity string
+	Method   string
+	Code     string
+	Message  string
+}
+
+// grpcActivityError is activityError for activities invoking gRPC methods. A call which failed
+// with a status becomes an application error typed by its code, see grpcErrorType, which is
+// retried if it is a RateLimitedError or a ServerError. A method the server does not describe
+// fails with a non retryable UnknownMethodError.
+func grpcActivityError(activityName string, method string, err error) error {
+	var unknownMethod *unknownMethodError
+	if errors.As(err, &unknownMethod) {
+		return temporal.NewNonRetryableApplicationError(fmt.Sprintf("activity %s: %s", activityName, err),
+			UnknownMethodError, err)
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return activityError("GrpcCallError", err)
+	}
+	message := fmt.Sprintf("activity %s: %s: %s: %s", activityName, method, st.Code(), st.Message())
+	errType := grpcErrorType(st.Code())
+	details := GrpcErrorDetails{Activity: activityName, Method: method, Code: st.Code().String(), Message: st.Message()}
+	if errType == RateLimitedError || errType == ServerError {
+		return temporal.NewApplicationError(message, errType, err, details)
+	}
+	return temporal.NewNonRetryableApplicationError(message, errType, err, details)
+}
+
+// graphqlErrorTypes are the types of the application errors of the common error codes of
+// GraphQL responses
+var graphqlErrorTypes = map[string]string{
+	"UNAUTHENTICATED":           UnauthorizedError,
+	"FORBIDDEN":                 UnauthorizedError,
+	"NOT_FOUND":                 NotFoundError,
+	"CONFLICT":                  ConflictError,
+	"RATE_LIMITED":              RateLimitedError,
+	"TOO_MANY_REQUESTS":         RateLimitedError,
+	"INTERNAL_SERVER_ERROR":     ServerError,
+	"SERVICE_UNAVAILABLE":       ServerError,
+	"BAD_USER_INPUT":            BadRequestError,
+	"GRAPHQL_PARSE_FAILED":      BadRequestError,
+	"GRAPHQL_VALIDATION_FAILED": BadRequestError,
+}
+
+// GraphQLErrorDetails are attached to the application errors of GraphQL responses with errors.
+// Data is the partial data of the response, if any, and Transcript the requests of the
+// activity attempt, if recorded.
+type GraphQLErrorDetails struct {
+	Activity   string
+	Url        string
+	StatusCode int
+	Errors     []GraphQLErrorEntry
+	Data       map[string]interface{} `json:",omitempty"`
+	Transcript *Transcript            `json:",omitempty"`
+}
+
+// graphqlActivityError is httpActivityError for graphql activities. A response with errors
+// becomes an application error typed by the `extensions.code` of its first error, see
+// graphqlErrorTypes, or by its status code if it failed, and a GraphQLError otherwise. Rate
+// limited and server errors are retried.
+func graphqlActivityError(ctx context.Context, activityName string, err error, retryable map[int]bool) error {
+	var responseErr *GraphQLResponseError
+	if !errors.As(err, &responseErr) {
+		return httpActivityError(ctx, activityName, "GraphQLActivity failed", err, retryable)
+	}
+	message := fmt.Sprintf("activity %s: %s", activityName, err)
+	details := GraphQLErrorDetails{
+		Activity:   activityName,
+		Url:        responseErr.Url,
+		StatusCode: responseErr.StatusCode,
+		Errors:     responseErr.Errors,
+		Data:       responseErr.Data,
+		Transcript: transcriptOf(ctx),
+	}
+	errType, ok := graphqlErrorTypes[responseErr.Errors[0].code()]
+	retry := errType == RateLimitedError || errType == ServerError
+	if !ok && responseErr.StatusCode >= http.StatusBadRequest {
+		errType = statusErrorType(responseErr.StatusCode)
+		retry = statusRetryable(responseErr.StatusCode, retryable)
+	} else if !ok {
+		errType = GraphQLError
+	}
+	if !retry {
+		return temporal.NewNonRetryableApplicationError(message, errType, err, details)
+	}
+	return temporal.NewApplicationError(message, errType, err, details)
+}
+
+// ScriptErrorDetails are attached to ScriptError failures. Backtrace is the Starlark backtrace
+// of the error, if any.
+type ScriptErrorDetails struct {
+	Activity  string
+	Message   string
+	Backtrace string `json:",omitempty"`
+}
+
+func newInvalidScriptError(activityName string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: invalid script: %s", activityName, err), InvalidScriptError, err)
+}
+
+// newScriptError fails a script which failed or exceeded its limits. Scripts are
+// deterministic, so they are not retried.
+func newScriptError(activityName string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: script failed: %s", activityName, err), ScriptError, err,
+		ScriptErrorDetails{Activity: activityName, Message: err.Error(), Backtrace: scriptBacktrace(err)})
+}
+
+func newUnknownPluginError(activityName string, pluginName string) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: plugin %s is not configured", activityName, pluginName),
+		UnknownPluginError, nil)
+}
+
+// PluginErrorDetails are attached to PluginError failures. Stderr is the beginning of what the
+// plugin wrote to stderr.
+type PluginErrorDetails struct {
+	Activity string
+	Plugin   string
+	Message  string
+	Stderr   string `json:",omitempty"`
+}
+
+// newPluginError fails a plugin which failed, exceeded its limits or wrote invalid output.
+// Like scripts, plugins are not retried.
+func newPluginError(activityName string, pluginName string, err error, stderr []byte) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: plugin %s failed: %s", activityName, pluginName, err), PluginError, err,
+		PluginErrorDetails{Activity: activityName, Plugin: pluginName, Message: err.Error(), Stderr: excerpt(stderr)})
+}
+
+func newRequestMarshalError(activityName string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: %s", activityName, err), RequestMarshalError, err)
+}
+
+// UnresolvedExpressionDetails are attached to UnresolvedExpressionError failures
+type UnresolvedExpressionDetails struct {
+	Activity    string
+	Expression  string
+	MissingPath string
+}
+
+func newUnresolvedExpressionError(activityName string, expr *ValueExpression, notFound *PathNotFoundError) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: value expression %q is unresolved, %s is missing",
+			activityName, expr.Expression, expr.Reference(notFound.Missing)),
+		UnresolvedExpressionError, notFound,
+		UnresolvedExpressionDetails{
+			Activity:    activityName,
+			Expression:  expr.Expression,
+			MissingPath: expr.Reference(notFound.Missing),
+		})
+}
+
+// newMissingResultError fails a value expression referring to an activity whose result the
+// workflow did not record, e.g. because the activity is not a dependency. Retrying the activity
+// cannot record it.
+func newMissingResultError(activityName string, expr *ValueExpression) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: value expression %q is unresolved, no result is recorded for activity %s",
+			activityName, expr.Expression, expr.Activity),
+		UnresolvedExpressionError, nil,
+		UnresolvedExpressionDetails{
+			Activity:    activityName,
+			Expression:  expr.Expression,
+			MissingPath: expr.Activity,
+		})
+}
+
+func newInvalidExpressionError(activityName string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: %s", activityName, err), InvalidExpressionError, err)
+}
+
+// ConditionEvaluationDetails are attached to ConditionEvaluationError failures
+type ConditionEvaluationDetails struct {
+	Activity    string
+	ResourceUrl string
+	Transcript  *Transcript `json:",omitempty"`
+}
+
+func newConditionEvaluationError(ctx context.Context, activityName string, resourceUrl string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: %s", activityName, err), ConditionEvaluationError, err,
+		ConditionEvaluationDetails{Activity: activityName, ResourceUrl: resourceUrl, Transcript: transcriptOf(ctx)})
+}
+
+// ResourceFailedDetails are attached to ResourceFailedError failures. Resource is the
+// representation of the resource which met the failure condition, it carries the error
+// reported by the backend.
+type ResourceFailedDetails struct {
+	Activity         string
+	ResourceUrl      string
+	FailureCondition string
+	Resource         map[string]interface{}
+	Transcript       *Transcript `json:",omitempty"`
+}
+
+func newResourceFailedError(ctx context.Context, activity *Activity, resourceUrl string,
+	resource map[string]interface{}) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: resource %s met failure condition %q",
+			activity.Name, resourceUrl, activity.FailureCondition),
+		ResourceFailedError, nil,
+		ResourceFailedDetails{
+			Activity:         activity.Name,
+			ResourceUrl:      resourceUrl,
+			FailureCondition: activity.FailureCondition,
+			Resource:         resource,
+			Transcript:       transcriptOf(ctx),
+		})
+}
+
+// ConditionTimeoutDetails are attached to ConditionTimeoutError failures. LastValues are the
+// last observed values of the fields the completeness condition refers to.
+type ConditionTimeoutDetails struct {
+	Activity              string
+	ResourceUrl           string
+	CompletenessCondition string
+	Waited                time.Duration
+	LastValues            map[string]interface{}
+	Transcript            *Transcript `json:",omitempty"`
+}
+
+func newConditionTimeoutError(ctx context.Context, activity *Activity, resourceUrl string, waited time.Duration,
+	lastValues map[string]interface{}) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: completeness condition %q not met after %s, last observed values %v",
+			activity.Name, activity.CompletenessCondition, waited.Round(time.Millisecond), lastValues),
+		ConditionTimeoutError, nil,
+		ConditionTimeoutDetails{
+			Activity:              activity.Name,
+			ResourceUrl:           resourceUrl,
+			CompletenessCondition: activity.CompletenessCondition,
+			Waited:                waited,
+			LastValues:            lastValues,
+			Transcript:            transcriptOf(ctx),
+		})
+}
+
+// newOperationTimeoutError fails an activity whose asynchronous operation did not complete
+// within the MaxDuration of its wait policy. The last status of the operation is reported as
+// the last value of its status path.
+func newOperationTimeoutError(ctx context.Context, activity *Activity, operationUrl string, waited time.Duration,
+	statusPath string, status string) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: operation %s not complete after %s, last status %q",
+			activity.Name, operationUrl, waited.Round(time.Millisecond), status),
+		ConditionTimeoutError, nil,
+		ConditionTimeoutDetails{
+			Activity:    activity.Name,
+			ResourceUrl: operationUrl,
+			Waited:      waited,
+			LastValues:  map[string]interface{}{statusPath: status},
+			Transcript:  transcriptOf(ctx),
+		})
+}
+
+func newUnknownServerError(activityName string, serverName string) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: server %s is not configured", activityName, serverName),
+		UnknownServerError, nil)
+}
+
+// newInvalidServerError fails an activity whose workflow declares a server with settings which
+// must be configured in the worker, or with credentials it may not use, see validateDeclared and
+// lendsCredentials
+func newInvalidServerError(activityName string, err error) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: %s", activityName, err), InvalidServerError, err)
+}
+
+// ResourceIdMissingDetails are attached to ResourceIdMissingError failures. Body is the
+// beginning of the response which lacks the id.
+type ResourceIdMissingDetails struct {
+	Activity   string
+	IdPath     string
+	Body       string
+	Transcript *Transcript `json:",omitempty"`
+}
+
+func newResourceIdMissingError(ctx context.Context, activityName string, idPath string, body []byte) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: no resource id at %s in response %s", activityName, idPath, excerpt(body)),
+		ResourceIdMissingError, nil,
+		ResourceIdMissingDetails{
+			Activity:   activityName,
+			IdPath:     idPath,
+			Body:       excerpt(body),
+			Transcript: transcriptOf(ctx),
+		})
+}
+
+// OperationFailedDetails are attached to OperationFailedError failures. Operation is the
+// beginning of the last representation of the status monitor, it carries the error reported
+// by the backend.
+type OperationFailedDetails struct {
+	Activity     string
+	OperationUrl string
+	Status       string
+	Operation    string
+	Transcript   *Transcript `json:",omitempty"`
+}
+
+func newOperationFailedError(ctx context.Context, activityName string, operationUrl string, status string,
+	body []byte) error {
+	return temporal.NewNonRetryableApplicationError(
+		fmt.Sprintf("activity %s: operation %s %s: %s", activityName, operationUrl, status, excerpt(body)),
+		OperationFailedError, nil,
+		OperationFailedDetails{
+			Activity:     activityName,
+			OperationUrl: operationUrl,
+			Status:       status,
+			Operation:    excerpt(body),
+			Transcript:   transcriptOf(ctx),
+		})
+}
@@ -0,0 +1,160 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// GraphQLParams is the document a graphql activity executes, a query or a mutation, e.g.
+//
+//	query Asset($id: ID!) { asset(id: $id) { id status } }
+//
+// The variables of the document are the resolved request body of the activity, and the
+// document is posted to the request path of the activity on its server (the base url if
+// empty). OperationName selects the operation of a document with several.
+//
+// The `data` of the response is the result of the activity. A query is executed again
+// following the wait policy of the activity until its completeness condition holds; a mutation
+// is executed once and cannot have a completeness condition.
+type GraphQLParams struct {
+	Document      string `yaml:"document"`
+	OperationName string `yaml:"operation_name"`
+}
+
+// graphqlComments matches the comments of a GraphQL document
+var graphqlComments = regexp.MustCompile(`#[^\n]*`)
+
+// graphqlMutation matches the definition of a mutation operation
+var graphqlMutation = regexp.MustCompile(`(^|[\s}])mutation\b[^{]*{`)
+
+// isMutation tells whether the document defines a mutation
+func (g GraphQLParams) isMutation() bool {
+	return graphqlMutation.MatchString(graphqlComments.ReplaceAllString(g.Document, ""))
+}
+
+// graphqlRequest is the body of a GraphQL request
+type graphqlRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+}
+
+// GraphQLErrorEntry is an entry of the `errors` of a GraphQL response
+type GraphQLErrorEntry struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// code returns the error code of the extensions of the error, e.g. NOT_FOUND
+func (e GraphQLErrorEntry) code() string {
+	code, _ := e.Extensions["code"].(string)
+	return code
+}
+
+type graphqlResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []GraphQLErrorEntry    `json:"errors"`
+}
+
+// GraphQLResponseError is a GraphQL response with errors
+type GraphQLResponseError struct {
+	Url        string
+	StatusCode int
+	Errors     []GraphQLErrorEntry
+	Data       map[string]interface{}
+}
+
+func (e *GraphQLResponseError) Error() string {
+	messages := []string{}
+	for _, graphqlErr := range e.Errors {
+		messages = append(messages, graphqlErr.Message)
+	}
+	return fmt.Sprintf("POST %s: %s", e.Url, strings.Join(messages, "; "))
+}
+
+// executeGraphQL posts the document of the activity with its variables and returns the data of
+// the response. A response with errors fails with a GraphQLResponseError, and a response
+// without them with a StatusError unless it succeeded.
+func executeGraphQL(ctx context.Context, client *resty.Client, activity *Activity, requestIdHeader string,
+	graphqlUrl string, variables []byte, workflowMetadata WorkflowMetadata) (map[string]interface{}, error) {
+	body, err := json.Marshal(graphqlRequest{
+		Query:         activity.GraphQL.Document,
+		OperationName: activity.GraphQL.OperationName,
+		Variables:     variables,
+	})
+	if err != nil {
+		return nil, newRequestMarshalError(activity.Name, err)
+	}
+	resp, err := client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(requestIdHeader, activity.requestId(workflowMetadata)).
+		SetBody(body).
+		Post(graphqlUrl)
+	if err != nil {
+		return nil, fmt.Errorf("GraphQLError: %w", err)
+	}
+	var graphqlResp graphqlResponse
+	if json.Unmarshal(resp.Body(), &graphqlResp) == nil && len(graphqlResp.Errors) > 0 {
+		return nil, &GraphQLResponseError{
+			Url:        graphqlUrl,
+			StatusCode: resp.StatusCode(),
+			Errors:     graphqlResp.Errors,
+			Data:       graphqlResp.Data,
+		}
+	}
+	if !resp.IsSuccess() {
+		return nil, fmt.Errorf("GraphQLError: %w", newStatusError(resp))
+	}
+	if graphqlResp.Data == nil {
+		return nil, fmt.Errorf("GraphQLError: POST %s: response without data: %s", graphqlUrl, excerpt(resp.Body()))
+	}
+	return graphqlResp.Data, nil
+}
+
+// GraphQLActivity executes the document of a graphql activity and returns the data of the
+// response as the result of the activity, see GraphQLParams. Errors of the response fail the
+// activity, see graphqlActivityError.
+func (a *Activities) GraphQLActivity(ctx context.Context, activity *Activity,
+	activityResults map[string]ActivityResult, workflowMetadata WorkflowMetadata) (ActivityResult, error) {
+
+	ctx, storeTranscript := a.startTranscript(ctx, activityIdentity(ctx, activity.Name, workflowMetadata))
+	defer storeTranscript()
+	server, err := a.Clients.Server(activity)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	client, err := a.Clients.Client(server)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	graphqlUrl := getResourceServerUrl(server, activity.RequestParams.Path)
+	requestIdHeader := resourceKindFor(activity, server).Lookup.requestIdHeader()
+	variables, err := resolveRequestBody(activity, activityResults, workflowMetadata)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+
+	conditions, err := parseActivityConditions(activity, graphqlUrl)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	data, err := conditions.poll(ctx, func(ctx context.Context) (map[string]interface{}, error) {
+		return executeGraphQL(ctx, client, activity, requestIdHeader, graphqlUrl, variables, workflowMetadata)
+	})
+	if err != nil {
+		return ActivityResult{}, graphqlActivityError(ctx, activity.Name, err, a.Clients.retryableStatus(server))
+	}
+
+	return ActivityResult{
+		Result:         ProjectOutputs(data, activity.Outputs),
+		Request:        activity.RequestParams.Body,
+		IdempotencyKey: activity.key,
+	}, nil
+}
@@ -0,0 +1,165 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+// assetGraphQLHandler is a small GraphQL backend of assets: the createAsset mutation creates an
+// asset which is ready after two queries
+func assetGraphQLHandler(t *testing.T) (http.Handler, func() []http.Header) {
+	var mu sync.Mutex
+	headers := []http.Header{}
+	queries := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		headers = append(headers, r.Header.Clone())
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.Contains(req.Query, "createAsset"):
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"createAsset": map[string]interface{}{"id": "asset-1", "name": req.Variables["name"]}}})
+		case req.Variables["id"] == "asset-1":
+			queries++
+			status := "processing"
+			if queries >= 2 {
+				status = "ready"
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+				"asset": map[string]interface{}{"id": "asset-1", "status": status}}})
+		case req.Variables["id"] == "overloaded":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"errors": [{"message": "try again later"}]}`))
+		default:
+			w.Write([]byte(`{"data": {"asset": null}, "errors": [{"message": "asset not found",
+				"path": ["asset"], "extensions": {"code": "NOT_FOUND"}}]}`))
+		}
+	})
+	return handler, func() []http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return headers
+	}
+}
+
+func graphqlActivity(name string, document string, variables map[string]interface{}) *Activity {
+	activity := &Activity{}
+	activity.Name = name
+	activity.Type = GraphQL
+	activity.GraphQL = GraphQLParams{Document: document}
+	activity.RequestParams = RequestParams{Path: "graphql", Body: variables}
+	return activity
+}
+
+func TestGraphQL(t *testing.T) {
+	handler, headers := assetGraphQLHandler(t)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	activities := NewActivities(&WorkerConfig{
+		Servers: map[string]ServerConfig{DefaultServerName: {BaseUrl: server.URL}},
+		Client:  ClientConfig{RetryCount: -1},
+	})
+	workflowMetadata := WorkflowMetadata{ID: "wf-1", RunID: "run-1"}
+	activityResults := map[string]ActivityResult{
+		"live_hooks": {Result: map[string]interface{}{"meta": map[string]interface{}{"name": "match-1"}}},
+	}
+
+	create := graphqlActivity("create_asset",
+		`mutation Create($name: String!) { createAsset(name: $name) { id name } }`,
+		map[string]interface{}{"name": "{{ live_hooks.result.meta.name }}"})
+	result, err := activities.GraphQLActivity(context.Background(), create, activityResults, workflowMetadata)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]interface{}{"createAsset": map[string]interface{}{"id": "asset-1", "name": "match-1"}},
+		result.Result)
+	assert.Equal(t, result.IdempotencyKey, headers()[0].Get(defaultRequestIdHeader))
+	activityResults["create_asset"] = result
+
+	// The data of the mutation is available to the next activity, whose query is repeated until
+	// it is complete
+	asset := graphqlActivity("asset",
+		`# The asset created by the workflow
+		query Asset($id: ID!) { asset(id: $id) { id status } }`,
+		map[string]interface{}{"id": "{{ create_asset.result.createAsset.id }}"})
+	asset.CompletenessCondition = "{{ .result.asset.status }} == 'ready'"
+	asset.Wait = WaitParams{InitialInterval: 10 * time.Millisecond}
+	asset.Outputs = []string{"asset.status"}
+	result, err = activities.GraphQLActivity(context.Background(), asset, activityResults, workflowMetadata)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"asset": map[string]interface{}{"status": "ready"}}, result.Result)
+	assert.Len(t, headers(), 3)
+
+	assertFails := func(id string, errType string, nonRetryable bool) *temporal.ApplicationError {
+		t.Helper()
+		activity := graphqlActivity("asset", `query Asset($id: ID!) { asset(id: $id) { id status } }`,
+			map[string]interface{}{"id": id})
+		_, err := activities.GraphQLActivity(context.Background(), activity, activityResults, workflowMetadata)
+		var appErr *temporal.ApplicationError
+		if assert.True(t, errors.As(err, &appErr), "%v", err) {
+			assert.Equal(t, errType, appErr.Type())
+			assert.Equal(t, nonRetryable, appErr.NonRetryable())
+		}
+		return appErr
+	}
+	appErr := assertFails("asset-2", NotFoundError, true)
+	var details GraphQLErrorDetails
+	if assert.NotNil(t, appErr) && assert.NoError(t, appErr.Details(&details)) {
+		assert.Equal(t, "asset not found", details.Errors[0].Message)
+		assert.Equal(t, []interface{}{"asset"}, details.Errors[0].Path)
+		assert.Equal(t, http.StatusOK, details.StatusCode)
+		assert.NotNil(t, details.Transcript)
+	}
+	// Errors without a known code are typed by the status of the response
+	assertFails("overloaded", ServerError, false)
+}
+
+func TestParseGraphQLWorkflow(t *testing.T) {
+	_, err := ParseWorkflow([]byte(`
+activities:
+  - name: asset
+    type: graphql
+    graphql:
+      document: |
+        query Asset($id: ID!) { asset(id: $id) { id status } }
+    request_params:
+      path: /graphql
+      body:
+        id: "{{ create_asset.result.createAsset.id }}"
+    completeness_condition: "{{ .result.asset.status }} == 'ready'"
+`))
+	assert.NoError(t, err)
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: create_asset
+    type: graphql
+    graphql:
+      document: |
+        mutation { createAsset(name: "match-1") { id status } }
+    completeness_condition: "{{ .result.createAsset.status }} == 'ready'"
+`))
+	assert.ErrorContains(t, err, "mutation")
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: asset
+    type: graphql
+`))
+	assert.ErrorContains(t, err, "graphql.document")
+}
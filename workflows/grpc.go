@@ -0,0 +1,377 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Schemes of the base urls of gRPC servers, with and without TLS
+const (
+	GrpcScheme    = "grpc"
+	GrpcTLSScheme = "grpcs"
+)
+
+// The server reflection services, the newer first
+var reflectionMethods = []string{
+	"/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+	"/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+}
+
+// GrpcParams is the unary method a grpc_call activity invokes on its server, by full name,
+// e.g. `grpc.health.v1.Health/Check`. The request message is the resolved request body of the
+// activity in the JSON mapping of protobuf, and the response message is its result, with the
+// field names of the proto file. Metadata is sent with the request in addition to the headers
+// of the server.
+//
+// The server has a grpc:// (plaintext) or grpcs:// base url. Its methods are described by its
+// DescriptorSets if it has any, and by server reflection otherwise.
+type GrpcParams struct {
+	Method   string            `yaml:"method"`
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// parseGrpcMethod splits the full name of a method, `package.Service/Method` or
+// `package.Service.Method`, into the names of the service and the method
+func parseGrpcMethod(name string) (string, string, error) {
+	name = strings.TrimPrefix(name, "/")
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		i = strings.LastIndex(name, ".")
+	}
+	if i <= 0 || i == len(name)-1 {
+		return "", "", fmt.Errorf("grpc method %q must be <package>.<service>/<method>", name)
+	}
+	return name[:i], name[i+1:], nil
+}
+
+// grpcClient is the connection of the worker to a gRPC server, with the descriptors of the
+// methods invoked so far
+type grpcClient struct {
+	conn   *grpc.ClientConn
+	server ServerConfig
+	// files are the descriptor sets of the server, nil if methods are resolved by reflection
+	files  *protoregistry.Files
+	tokens *oauth2TokenSource
+
+	mu      sync.Mutex
+	methods map[string]protoreflect.MethodDescriptor
+}
+
+func newGrpcClient(server ServerConfig) (*grpcClient, error) {
+	u, err := url.Parse(server.BaseUrl)
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == GrpcTLSScheme {
+		tlsConfig, err := server.TLS.clientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("ServerConfigError: %w", err)
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	client := &grpcClient{server: server, methods: map[string]protoreflect.MethodDescriptor{}}
+	if len(server.DescriptorSets) > 0 {
+		client.files, err = loadDescriptorSets(server.DescriptorSets)
+		if err != nil {
+			return nil, fmt.Errorf("ServerConfigError: %w", err)
+		}
+	}
+	if server.Auth.Type == AuthOAuth2ClientCredentials {
+		client.tokens, err = sharedTokenSource(server.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("ServerConfigError: %w", err)
+		}
+	}
+	client.conn, err = grpc.NewClient(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	return client, nil
+}
+
+// GrpcClient returns the connection to a gRPC server
+func (f *ClientFactory) GrpcClient(server ServerConfig) (*grpcClient, error) {
+	key, err := json.Marshal(server)
+	if err != nil {
+		return nil, fmt.Errorf("ServerConfigError: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	client, ok := f.grpcClients[string(key)]
+	if ok {
+		return client, nil
+	}
+	client, err = newGrpcClient(server)
+	if err != nil {
+		return nil, err
+	}
+	f.grpcClients[string(key)] = client
+	return client, nil
+}
+
+// loadDescriptorSets reads binary FileDescriptorSets, as written by
+// `protoc --include_imports --descriptor_set_out`
+func loadDescriptorSets(paths []string) (*protoregistry.Files, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fileSet := &descriptorpb.FileDescriptorSet{}
+		err = proto.Unmarshal(data, fileSet)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, file := range fileSet.File {
+			if !seen[file.GetName()] {
+				seen[file.GetName()] = true
+				set.File = append(set.File, file)
+			}
+		}
+	}
+	return protodesc.NewFiles(set)
+}
+
+// method returns the descriptor of a unary method of the server
+func (c *grpcClient) method(ctx context.Context, name string) (protoreflect.MethodDescriptor, error) {
+	c.mu.Lock()
+	method, ok := c.methods[name]
+	c.mu.Unlock()
+	if ok {
+		return method, nil
+	}
+	serviceName, methodName, err := parseGrpcMethod(name)
+	if err != nil {
+		return nil, err
+	}
+	files := c.files
+	if files == nil {
+		files, err = reflectFiles(ctx, c.conn, serviceName)
+		if status.Code(err) == codes.NotFound {
+			return nil, &unknownMethodError{Method: name, Reason: status.Convert(err).Message()}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, &unknownMethodError{Method: name, Reason: err.Error()}
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, &unknownMethodError{Method: name, Reason: serviceName + " is not a service"}
+	}
+	method = service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, &unknownMethodError{Method: name, Reason: "no method " + methodName}
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, &unknownMethodError{Method: name, Reason: "streaming methods are not supported"}
+	}
+	c.mu.Lock()
+	c.methods[name] = method
+	c.mu.Unlock()
+	return method, nil
+}
+
+type unknownMethodError struct {
+	Method string
+	Reason string
+}
+
+func (e *unknownMethodError) Error() string {
+	return fmt.Sprintf("grpc method %s: %s", e.Method, e.Reason)
+}
+
+// reflectFiles returns the descriptors of the file defining symbol and of its dependencies, as
+// described by the reflection service of the server
+func reflectFiles(ctx context.Context, conn *grpc.ClientConn, symbol string) (*protoregistry.Files, error) {
+	var err error
+	for _, method := range reflectionMethods {
+		var files *protoregistry.Files
+		files, err = reflectFilesWith(ctx, conn, method, symbol)
+		if status.Code(err) != codes.Unimplemented {
+			return files, err
+		}
+	}
+	return nil, err
+}
+
+// reflectFilesWith queries a reflection service. The messages of both versions of the service
+// are the same.
+func reflectFilesWith(ctx context.Context, conn *grpc.ClientConn, method string, symbol string) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, method)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]*descriptorpb.FileDescriptorProto{}
+	request := &reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	}
+	for request != nil {
+		err = stream.SendMsg(request)
+		if err != nil {
+			return nil, err
+		}
+		resp := &reflectionpb.ServerReflectionResponse{}
+		err = stream.RecvMsg(resp)
+		if err != nil {
+			return nil, err
+		}
+		if errResp := resp.GetErrorResponse(); errResp != nil {
+			return nil, status.Error(codes.Code(errResp.ErrorCode), errResp.ErrorMessage)
+		}
+		for _, data := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			err = proto.Unmarshal(data, file)
+			if err != nil {
+				return nil, err
+			}
+			files[file.GetName()] = file
+		}
+		// Dependencies the server did not send are requested, unless they are linked in
+		request = nil
+		for _, file := range files {
+			for _, dependency := range file.GetDependency() {
+				if _, ok := files[dependency]; ok {
+					continue
+				}
+				if known, err := protoregistry.GlobalFiles.FindFileByPath(dependency); err == nil {
+					files[dependency] = protodesc.ToFileDescriptorProto(known)
+					continue
+				}
+				request = &reflectionpb.ServerReflectionRequest{
+					MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{FileByFilename: dependency},
+				}
+			}
+		}
+	}
+	stream.CloseSend()
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, file := range files {
+		set.File = append(set.File, file)
+	}
+	return protodesc.NewFiles(set)
+}
+
+// metadata returns the metadata of a request of an activity: the headers of the server, the
+// metadata of the activity, the identity headers and the authentication of the server
+func (c *grpcClient) metadata(ctx context.Context, identity requestIdentity, extra map[string]string) (metadata.MD, error) {
+	md := metadata.MD{}
+	for name, value := range c.server.Headers {
+		md.Set(name, value)
+	}
+	for name, value := range extra {
+		md.Set(name, value)
+	}
+	for name, value := range identity.headers(c.server.IdentityHeaders.withDefaults()) {
+		if len(md.Get(name)) == 0 {
+			md.Set(name, value)
+		}
+	}
+	switch c.server.Auth.Type {
+	case AuthBearer:
+		md.Set("authorization", "Bearer "+c.server.Auth.Token)
+	case AuthApiKey:
+		header := c.server.Auth.Header
+		if header == "" {
+			header = defaultApiKeyHeader
+		}
+		md.Set(header, c.server.Auth.Key)
+	case AuthOAuth2ClientCredentials:
+		token, err := c.tokens.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		md.Set("authorization", "Bearer "+token)
+	}
+	return md, nil
+}
+
+// GrpcCallActivity invokes the method of a grpc_call activity with its resolved request body
+// and returns the response as the result of the activity, see GrpcParams. Calls failing with a
+// status are typed like failed HTTP requests, see grpcActivityError.
+func (a *Activities) GrpcCallActivity(ctx context.Context, activity *Activity,
+	activityResults map[string]ActivityResult, workflowMetadata WorkflowMetadata) (ActivityResult, error) {
+
+	identity := activityIdentity(ctx, activity.Name, workflowMetadata)
+	server, err := a.Clients.Server(activity)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	client, err := a.Clients.GrpcClient(server)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	reqJson, err := resolveRequestBody(activity, activityResults, workflowMetadata)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+
+	timeout := server.Timeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	method, err := client.method(ctx, activity.Grpc.Method)
+	if err != nil {
+		return ActivityResult{}, grpcActivityError(activity.Name, activity.Grpc.Method, err)
+	}
+	request := dynamicpb.NewMessage(method.Input())
+	err = protojson.Unmarshal(reqJson, request)
+	if err != nil {
+		return ActivityResult{}, newRequestMarshalError(activity.Name, err)
+	}
+	md, err := client.metadata(ctx, identity, activity.Grpc.Metadata)
+	if err != nil {
+		return ActivityResult{}, activityError("GrpcCallError", err)
+	}
+	response := dynamicpb.NewMessage(method.Output())
+	fullMethod := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+	err = client.conn.Invoke(metadata.NewOutgoingContext(ctx, md), fullMethod, request, response)
+	if err != nil {
+		return ActivityResult{}, grpcActivityError(activity.Name, activity.Grpc.Method, err)
+	}
+
+	data, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(response)
+	if err != nil {
+		return ActivityResult{}, activityError("GrpcCallError", err)
+	}
+	result := map[string]interface{}{}
+	err = json.Unmarshal(data, &result)
+	if err != nil {
+		return ActivityResult{}, activityError("GrpcCallError", err)
+	}
+	return ActivityResult{
+		Result:         ProjectOutputs(result, activity.Outputs),
+		Request:        activity.RequestParams.Body,
+		IdempotencyKey: activity.key,
+	}, nil
+}
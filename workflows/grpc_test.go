@@ -0,0 +1,162 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// startGrpcServer serves the health service of the abr converter, with server reflection if
+// reflect is set, and records the metadata of the requests
+func startGrpcServer(t *testing.T, reflect bool) (string, func() metadata.MD) {
+	var mu sync.Mutex
+	var md metadata.MD
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		md, _ = metadata.FromIncomingContext(ctx)
+		mu.Unlock()
+		return handler(ctx, req)
+	}))
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("abr-converter", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	if reflect {
+		reflection.Register(server)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return "grpc://" + lis.Addr().String(), func() metadata.MD {
+		mu.Lock()
+		defer mu.Unlock()
+		return md
+	}
+}
+
+func grpcCallActivity(server string, method string, body map[string]interface{}) *Activity {
+	activity := &Activity{}
+	activity.Name = "converter_health"
+	activity.Type = GrpcCall
+	activity.Server = server
+	activity.Grpc = GrpcParams{Method: method, Metadata: map[string]string{"x-probe": "workflow"}}
+	activity.RequestParams = RequestParams{Body: body}
+	return activity
+}
+
+func TestGrpcCall(t *testing.T) {
+	reflected, reflectedMetadata := startGrpcServer(t, true)
+	described, _ := startGrpcServer(t, false)
+
+	// The descriptor set of the health service, as protoc would write it
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)}}
+	data, err := proto.Marshal(set)
+	assert.NoError(t, err)
+	descriptorSet := filepath.Join(t.TempDir(), "health.pb")
+	assert.NoError(t, os.WriteFile(descriptorSet, data, 0o644))
+
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  reflected:
+    base_url: ` + reflected + `
+    headers:
+      x-tenant: media
+    auth:
+      type: bearer
+      token: secret
+  described:
+    base_url: ` + described + `
+    descriptor_sets:
+      - ` + descriptorSet + `
+`))
+	assert.NoError(t, err)
+	activities := NewActivities(cfg)
+	converter := map[string]ActivityResult{"converter": {Result: map[string]interface{}{
+		"meta": map[string]interface{}{"name": "abr-converter"}}}}
+	workflowMetadata := WorkflowMetadata{ID: "wf-1", RunID: "run-1"}
+
+	for _, server := range []string{"reflected", "described"} {
+		activity := grpcCallActivity(server, "grpc.health.v1.Health/Check",
+			map[string]interface{}{"service": "{{ converter.result.meta.name }}"})
+		result, err := activities.GrpcCallActivity(context.Background(), activity, converter, workflowMetadata)
+		if assert.NoError(t, err, server) {
+			assert.Equal(t, map[string]interface{}{"status": "SERVING"}, result.Result)
+			assert.Equal(t, map[string]interface{}{"service": "abr-converter"}, result.Request)
+			assert.Empty(t, result.ResourceUrl)
+		}
+	}
+	md := reflectedMetadata()
+	assert.Equal(t, []string{"media"}, md.Get("x-tenant"))
+	assert.Equal(t, []string{"workflow"}, md.Get("x-probe"))
+	assert.Equal(t, []string{"Bearer secret"}, md.Get("authorization"))
+	assert.Equal(t, []string{"wf-1"}, md.Get(defaultWorkflowIdHeader))
+	assert.Equal(t, []string{"converter_health"}, md.Get(defaultActivityNameHeader))
+
+	assertFails := func(activity *Activity, errType string, nonRetryable bool) {
+		t.Helper()
+		_, err := activities.GrpcCallActivity(context.Background(), activity, converter, workflowMetadata)
+		var appErr *temporal.ApplicationError
+		if assert.True(t, errors.As(err, &appErr), "%v", err) {
+			assert.Equal(t, errType, appErr.Type())
+			assert.Equal(t, nonRetryable, appErr.NonRetryable())
+		}
+	}
+	// The status of a failed call types the error
+	assertFails(grpcCallActivity("reflected", "grpc.health.v1.Health.Check",
+		map[string]interface{}{"service": "packager"}), NotFoundError, true)
+	assertFails(grpcCallActivity("described", "grpc.health.v1.Health/Probe", nil), UnknownMethodError, true)
+	assertFails(grpcCallActivity("reflected", "media.Converter/Convert", nil), UnknownMethodError, true)
+	assertFails(grpcCallActivity("reflected", "grpc.health.v1.Health/Watch", nil), UnknownMethodError, true)
+	assertFails(grpcCallActivity("reflected", "grpc.health.v1.Health/Check",
+		map[string]interface{}{"services": "abr-converter"}), RequestMarshalError, true)
+
+	// An unavailable server is retried
+	cfg.Servers["gone"] = ServerConfig{BaseUrl: "grpc://127.0.0.1:1"}
+	assertFails(grpcCallActivity("gone", "grpc.health.v1.Health/Check", nil), ServerError, false)
+}
+
+func TestParseGrpcWorkflow(t *testing.T) {
+	_, err := ParseWorkflow([]byte(`
+activities:
+  - name: converter_health
+    type: grpc_call
+    server: control
+    grpc:
+      method: grpc.health.v1.Health/Check
+    request_params:
+      body:
+        service: abr-converter
+`))
+	assert.NoError(t, err)
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: converter_health
+    type: grpc_call
+`))
+	assert.ErrorContains(t, err, "grpc.method")
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: converter_health
+    type: soap_call
+`))
+	assert.ErrorContains(t, err, "unknown activity type")
+}
@@ -0,0 +1,94 @@
+package workflows
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/davegardnerisme/deephash"
+)
+
+// bodyHashField is the field of the activity namespace with the hash of the resolved request
+// body. It is available to idempotency key templates only.
+const bodyHashField = "body_hash"
+
+// requestIdField is the field of the activity namespace with the idempotency key
+const requestIdField = "request_id"
+
+// defaultRequestId is the idempotency key of an activity without an idempotency key template.
+// It stays the same when the workflow is rerun with the same id or reset.
+func defaultRequestId(workflowId string, activityName string) string {
+	hv := deephash.Hash(map[string]string{"workflowId": workflowId, "activityName": activityName})
+	return fmt.Sprintf("%x", hv)
+}
+
+// keyNeedsBody tells whether an idempotency key template refers to the request body, which
+// has to be resolved before the key.
+func keyNeedsBody(template string) bool {
+	return strings.Contains(template, ActivityNamespace+"."+bodyHashField)
+}
+
+// idempotencyKey computes the idempotency key of the activity, which identifies its resource
+// across attempts: the key is sent as the request id of the lookup and the create requests and
+// is `activity.request_id` in templates and request bodies. Without an IdempotencyKey template
+// it is derived from the workflow id and the activity name. Otherwise it is the hash of the
+// resolved template, which can refer to the workflow namespace (e.g. `workflow.run_id`) and
+// to the activity namespace, including `activity.body_hash`, the hash of the resolved request
+// body. body is nil if the template does not need it.
+func idempotencyKey(activity *Activity, workflowMetadata WorkflowMetadata, body []byte) (string, error) {
+	if activity.IdempotencyKey == "" {
+		return defaultRequestId(workflowMetadata.ID, activity.Name), nil
+	}
+	var extra map[string]interface{}
+	if body != nil {
+		bodyHash := sha256.Sum256(body)
+		extra = map[string]interface{}{bodyHashField: hex.EncodeToString(bodyHash[:])}
+	}
+	resolved, err := resolveTemplate(activity.IdempotencyKey, activity, workflowMetadata, extra)
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(resolved))
+	return hex.EncodeToString(key[:16]), nil
+}
+
+// validateIdempotencyKey checks that the idempotency key of the activity can be computed before
+// the value expressions referring to it are resolved. The key cannot refer to itself, and a
+// request body whose hash is part of the key cannot refer to the key.
+func (a *ActivityParams) validateIdempotencyKey() error {
+	if refersToRequestId(a.IdempotencyKey) {
+		return fmt.Errorf("idempotency_key cannot refer to %s.%s", ActivityNamespace, requestIdField)
+	}
+	if !keyNeedsBody(a.IdempotencyKey) {
+		return nil
+	}
+	for _, m := range FindPathAndValuesWithPattern(valueExpressionPattern, a.RequestParams.Body, Path{}, nil) {
+		if refersToRequestId(m.value) {
+			return fmt.Errorf("request_params.body.%s cannot refer to %s.%s, the idempotency key is derived from the body",
+				m.path, ActivityNamespace, requestIdField)
+		}
+	}
+	return nil
+}
+
+// refersToRequestId tells whether a template refers to the idempotency key of the activity
+func refersToRequestId(template string) bool {
+	for _, ve := range FindValueExpressions(template) {
+		expr, err := ParseValueExpression(ve)
+		if err == nil && expr.Activity == ActivityNamespace && len(expr.Path) > 0 &&
+			expr.Path[0].Key == requestIdField {
+			return true
+		}
+	}
+	return false
+}
+
+// requestId returns the idempotency key of the activity, once it has been computed by the
+// activity, or the default key otherwise.
+func (a *Activity) requestId(workflowMetadata WorkflowMetadata) string {
+	if a.key != "" {
+		return a.key
+	}
+	return defaultRequestId(workflowMetadata.ID, a.Name)
+}
@@ -0,0 +1,97 @@
+package workflows
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	defer func(delay time.Duration) { liveHooksCreateDelay = delay }(liveHooksCreateDelay)
+	liveHooksCreateDelay = 0
+
+	server := httptest.NewServer(newMockRouter())
+	defer server.Close()
+	activities := NewActivities(&WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL},
+	}})
+	run := func(activity *Activity, workflowMetadata WorkflowMetadata, port int) ActivityResult {
+		activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST",
+			Body: map[string]interface{}{"sender_ip": "10.0.0.1", "sender_port": port}}
+		result, err := activities.ActivityProcessAPICall(context.Background(), activity, nil, workflowMetadata)
+		assert.NoError(t, err)
+		return result
+	}
+
+	// By default the key is derived from the workflow id and the activity name
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	first := run(&activity, WorkflowMetadata{ID: "idempotency-default", RunID: "run-1"}, 1935)
+	assert.Equal(t, defaultRequestId("idempotency-default", "live_hooks"), first.IdempotencyKey)
+	changed := run(&activity, WorkflowMetadata{ID: "idempotency-default", RunID: "run-2"}, 1936)
+	assert.Equal(t, first.ResourceUrl, changed.ResourceUrl)
+
+	// A key derived from the request body creates a new resource for a changed body
+	activity.IdempotencyKey = "{{ workflow.id }}/{{ activity.name }}/{{ activity.body_hash }}"
+	first = run(&activity, WorkflowMetadata{ID: "idempotency-body", RunID: "run-1"}, 1935)
+	retry := run(&activity, WorkflowMetadata{ID: "idempotency-body", RunID: "run-2"}, 1935)
+	changed = run(&activity, WorkflowMetadata{ID: "idempotency-body", RunID: "run-1"}, 1936)
+	assert.Equal(t, first.IdempotencyKey, retry.IdempotencyKey)
+	assert.Equal(t, first.ResourceUrl, retry.ResourceUrl)
+	assert.NotEqual(t, first.IdempotencyKey, changed.IdempotencyKey)
+	assert.NotEqual(t, first.ResourceUrl, changed.ResourceUrl)
+	assert.Equal(t, 2, mockResourcesOf("idempotency-body"))
+
+	// A key derived from the run creates a new resource for a reset workflow
+	activity.IdempotencyKey = "{{ workflow.run_id }}/{{ activity.name }}"
+	first = run(&activity, WorkflowMetadata{ID: "idempotency-run", RunID: "run-1"}, 1935)
+	retry = run(&activity, WorkflowMetadata{ID: "idempotency-run", RunID: "run-1"}, 1935)
+	reset := run(&activity, WorkflowMetadata{ID: "idempotency-run", RunID: "run-2"}, 1935)
+	assert.Equal(t, first.ResourceUrl, retry.ResourceUrl)
+	assert.NotEqual(t, first.ResourceUrl, reset.ResourceUrl)
+
+	// Explicit inputs, and the request body referring to the key
+	activity.IdempotencyKey = "{{ workflow.labels.stream }}"
+	activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST",
+		Body: map[string]interface{}{"sender_ip": "10.0.0.1", "sender_port": 1935, "key": "{{ activity.request_id }}"}}
+	workflowMetadata := WorkflowMetadata{ID: "idempotency-labels", Labels: map[string]string{"stream": "s1"}}
+	result, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+	assert.NoError(t, err)
+	assert.Len(t, result.IdempotencyKey, 32)
+	assert.Equal(t, result.IdempotencyKey, result.Request["key"])
+}
+
+func TestParseIdempotencyKey(t *testing.T) {
+	_, err := ParseWorkflow([]byte(`
+activities:
+  - name: live_hooks
+    idempotency_key: "{{ workflow.id }}/{{ activity.body_hash }}"
+    request_params:
+      body:
+        key: "{{ activity.name }}"
+`))
+	assert.NoError(t, err)
+
+	// The key would be resolved with the default key in place of itself
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: live_hooks
+    idempotency_key: "{{ workflow.id }}/{{ activity.request_id }}"
+`))
+	assert.ErrorContains(t, err, "idempotency_key cannot refer to activity.request_id")
+
+	// The body would be resolved with the default key, and the request sent with the derived one
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: live_hooks
+    idempotency_key: "{{ workflow.id }}/{{ activity.body_hash }}"
+    request_params:
+      body:
+        meta:
+          key: "req-{{ activity.request_id }}"
+`))
+	assert.ErrorContains(t, err, "request_params.body.meta.key cannot refer to activity.request_id")
+}
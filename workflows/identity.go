@@ -0,0 +1,145 @@
+package workflows
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"go.temporal.io/sdk/activity"
+)
+
+// Default names of the identity headers
+const (
+	defaultWorkflowIdHeader   = "x-workflow-id"
+	defaultRunIdHeader        = "x-workflow-run-id"
+	defaultActivityNameHeader = "x-activity-name"
+	defaultAttemptHeader      = "x-activity-attempt"
+	defaultTraceparentHeader  = "traceparent"
+)
+
+// omitHeader is the name of an identity header which is not sent
+const omitHeader = "-"
+
+// IdentityHeaders names the headers identifying the workflow and the activity on whose behalf
+// a request is sent. Every request of an activity carries its workflow id, run id, activity
+// name and attempt, and a W3C traceparent whose trace id is derived from the workflow run, so
+// that the requests of a run belong to one trace. Unset names are the defaults
+// (x-workflow-id, x-workflow-run-id, x-activity-name, x-activity-attempt and traceparent), and
+// a header named "-" is not sent.
+type IdentityHeaders struct {
+	WorkflowId   string `yaml:"workflow_id"`
+	RunId        string `yaml:"run_id"`
+	ActivityName string `yaml:"activity_name"`
+	Attempt      string `yaml:"attempt"`
+	Traceparent  string `yaml:"traceparent"`
+}
+
+func (h IdentityHeaders) withDefaults() IdentityHeaders {
+	if h.WorkflowId == "" {
+		h.WorkflowId = defaultWorkflowIdHeader
+	}
+	if h.RunId == "" {
+		h.RunId = defaultRunIdHeader
+	}
+	if h.ActivityName == "" {
+		h.ActivityName = defaultActivityNameHeader
+	}
+	if h.Attempt == "" {
+		h.Attempt = defaultAttemptHeader
+	}
+	if h.Traceparent == "" {
+		h.Traceparent = defaultTraceparentHeader
+	}
+	return h
+}
+
+// requestIdentity identifies the workflow and the activity on whose behalf requests are sent
+type requestIdentity struct {
+	WorkflowId   string
+	RunId        string
+	ActivityName string
+	Attempt      int32
+}
+
+type requestIdentityKey struct{}
+
+// withRequestIdentity returns a context whose requests carry the identity headers of identity
+func withRequestIdentity(ctx context.Context, identity requestIdentity) context.Context {
+	return context.WithValue(ctx, requestIdentityKey{}, identity)
+}
+
+// activityIdentity returns the identity of the requests of an activity of a workflow. The
+// attempt, and the workflow if the metadata has none, are taken from the activity info when the
+// activity is run by a worker.
+func activityIdentity(ctx context.Context, activityName string, workflowMetadata WorkflowMetadata) requestIdentity {
+	identity := requestIdentity{
+		WorkflowId:   workflowMetadata.ID,
+		RunId:        workflowMetadata.RunID,
+		ActivityName: activityName,
+	}
+	if activity.IsActivity(ctx) {
+		info := activity.GetInfo(ctx)
+		identity.Attempt = info.Attempt
+		if identity.WorkflowId == "" {
+			identity.WorkflowId = info.WorkflowExecution.ID
+			identity.RunId = info.WorkflowExecution.RunID
+		}
+	}
+	return identity
+}
+
+// traceparent returns a W3C traceparent for a request of the workflow run. The trace id is
+// derived from the run and the parent id is new for every request.
+func (i requestIdentity) traceparent() string {
+	traceId := sha256.Sum256([]byte(i.WorkflowId + "/" + i.RunId))
+	parentId := make([]byte, 8)
+	rand.Read(parentId)
+	return "00-" + hex.EncodeToString(traceId[:16]) + "-" + hex.EncodeToString(parentId) + "-01"
+}
+
+// identityTransport sets the identity headers of the activity sending a request, if any
+type identityTransport struct {
+	base    http.RoundTripper
+	headers IdentityHeaders
+}
+
+func newIdentityTransport(base http.RoundTripper, headers IdentityHeaders) http.RoundTripper {
+	return &identityTransport{base: base, headers: headers.withDefaults()}
+}
+
+func (t *identityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	identity, ok := req.Context().Value(requestIdentityKey{}).(requestIdentity)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, value := range identity.headers(t.headers) {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// headers returns the identity headers of the identity named by names, which have defaults
+func (i requestIdentity) headers(names IdentityHeaders) map[string]string {
+	headers := map[string]string{}
+	set := func(name string, value string) {
+		if name != omitHeader && value != "" {
+			headers[name] = value
+		}
+	}
+	set(names.WorkflowId, i.WorkflowId)
+	set(names.RunId, i.RunId)
+	set(names.ActivityName, i.ActivityName)
+	if i.Attempt > 0 {
+		set(names.Attempt, strconv.Itoa(int(i.Attempt)))
+	}
+	if i.WorkflowId != "" {
+		set(names.Traceparent, i.traceparent())
+	}
+	return headers
+}
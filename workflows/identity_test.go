@@ -0,0 +1,84 @@
+package workflows
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/testsuite"
+)
+
+func TestIdentityHeaders(t *testing.T) {
+	var mu sync.Mutex
+	headers := []http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/live_hooks":
+			http.Error(w, "Not found", http.StatusNotFound)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			fallthrough
+		default:
+			w.Write([]byte(`{"meta": {"resource_id": "1", "status": "created"}}`))
+		}
+	}))
+	defer server.Close()
+
+	cfg := &WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL},
+		"renamed": {BaseUrl: server.URL, IdentityHeaders: IdentityHeaders{
+			WorkflowId: "x-correlation-id", Attempt: omitHeader}},
+	}}
+	suite := testsuite.WorkflowTestSuite{}
+	env := suite.NewTestActivityEnvironment()
+	env.RegisterActivity(NewActivities(cfg))
+
+	var activities *Activities
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST"}
+	workflowMetadata := WorkflowMetadata{ID: "wf-1", RunID: "run-1"}
+	_, err := env.ExecuteActivity(activities.ActivityProcessAPICall, &activity, nil, workflowMetadata)
+	assert.NoError(t, err)
+	_, err = env.ExecuteActivity(activities.CleanupActivity,
+		[]CreatedResource{{Url: server.URL + "/live_hooks/1", Server: DefaultServerName}})
+	assert.NoError(t, err)
+	activity.Server = "renamed"
+	_, err = env.ExecuteActivity(activities.ActivityProcessAPICall, &activity, nil, workflowMetadata)
+	assert.NoError(t, err)
+
+	// The lookup, the create and the get of each activity, and the cleanup
+	traceparent := regexp.MustCompile(`^00-([0-9a-f]{32})-[0-9a-f]{16}-01$`)
+	if !assert.Len(t, headers, 7) {
+		return
+	}
+	var traceId string
+	for i, h := range headers[:3] {
+		assert.Equal(t, "wf-1", h.Get("x-workflow-id"), i)
+		assert.Equal(t, "run-1", h.Get("x-workflow-run-id"), i)
+		assert.Equal(t, "live_hooks", h.Get("x-activity-name"), i)
+		assert.Equal(t, "1", h.Get("x-activity-attempt"), i)
+		match := traceparent.FindStringSubmatch(h.Get("traceparent"))
+		if assert.Len(t, match, 2, i) {
+			if traceId == "" {
+				traceId = match[1]
+			}
+			assert.Equal(t, traceId, match[1], "the requests of a run share a trace")
+		}
+	}
+	assert.NotEqual(t, headers[0].Get("traceparent"), headers[1].Get("traceparent"))
+	assert.Equal(t, "CleanupActivity", headers[3].Get("x-activity-name"))
+	assert.NotEmpty(t, headers[3].Get("traceparent"))
+
+	renamed := headers[5]
+	assert.Equal(t, "wf-1", renamed.Get("x-correlation-id"))
+	assert.Empty(t, renamed.Get("x-workflow-id"))
+	assert.Empty(t, renamed.Get("x-activity-attempt"))
+	assert.Equal(t, "live_hooks", renamed.Get("x-activity-name"))
+}
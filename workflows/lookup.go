@@ -0,0 +1,177 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/tidwall/gjson"
+)
+
+// Strategies to look up the resource an activity created in an earlier attempt, so that a
+// retried activity does not create it again
+const (
+	LookupHeader = "header"
+	LookupQuery  = "query"
+	LookupList   = "list"
+	LookupNone   = "none"
+)
+
+const defaultRequestIdHeader = "x-request-id"
+
+// LookupParams configures how the resource of an activity is looked up in its collection
+// before it is created:
+//
+//   - header (default): `GET <collection>` with the request id of the activity in Header
+//     (x-request-id by default). The request id is sent with the create request as well, it
+//     is the idempotency key of the activity, see idempotencyKey.
+//   - query: `GET <collection>` with the Query parameters, e.g.
+//     `workflow_id: "{{ workflow.id }}"` and `activity_name: "{{ activity.name }}"`
+//   - list: `GET <collection>` (with the Query parameters, if any), then the first item of the
+//     list at ItemsPath (gjson syntax, the whole response if empty) whose Match paths have the
+//     given values
+//   - none: the resource is always created
+//
+// Query and Match values are templates over the workflow and activity namespaces. A 404
+// response, or no matching item, means the resource does not exist yet.
+type LookupParams struct {
+	Strategy  string            `yaml:"strategy"`
+	Header    string            `yaml:"header"`
+	Query     map[string]string `yaml:"query"`
+	ItemsPath string            `yaml:"items_path"`
+	Match     map[string]string `yaml:"match"`
+}
+
+func (l LookupParams) validate() error {
+	switch l.Strategy {
+	case "", LookupHeader, LookupNone:
+	case LookupQuery:
+		if len(l.Query) == 0 {
+			return fmt.Errorf("lookup: query requires query parameters")
+		}
+	case LookupList:
+		if len(l.Match) == 0 {
+			return fmt.Errorf("lookup: list requires match")
+		}
+	default:
+		return fmt.Errorf("lookup: unknown strategy %q", l.Strategy)
+	}
+	return nil
+}
+
+func (l LookupParams) requestIdHeader() string {
+	if l.Strategy == LookupHeader && l.Header != "" {
+		return l.Header
+	}
+	return defaultRequestIdHeader
+}
+
+// resolveTemplate interpolates the value expressions of a template, which can refer to the
+// workflow and activity namespaces only. The fields of extra are added to the activity
+// namespace.
+func resolveTemplate(template string, activity *Activity, workflowMetadata WorkflowMetadata,
+	extra map[string]interface{}) (string, error) {
+	value, err := InterpolateValueExpressions(template, func(ve string) (interface{}, error) {
+		expr, err := ParseValueExpression(ve)
+		if err != nil {
+			return nil, newInvalidExpressionError(activity.Name, err)
+		}
+		var obj map[string]interface{}
+		switch expr.Activity {
+		case WorkflowNamespace:
+			obj = workflowMetadata.namespaceObject()
+		case ActivityNamespace:
+			obj = activityNamespaceObject(activity, workflowMetadata)
+			for k, v := range extra {
+				obj[k] = v
+			}
+		default:
+			return nil, newInvalidExpressionError(activity.Name,
+				fmt.Errorf("%q: only the workflow and activity namespaces can be used here", ve))
+		}
+		return expr.Evaluate(obj)
+	})
+	if err != nil {
+		return "", err
+	}
+	return valueToString(value), nil
+}
+
+func resolveTemplates(templates map[string]string, activity *Activity,
+	workflowMetadata WorkflowMetadata) (map[string]string, error) {
+	resolved := map[string]string{}
+	for k, template := range templates {
+		value, err := resolveTemplate(template, activity, workflowMetadata, nil)
+		if err != nil {
+			return nil, err
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
+// GetResourceIfExists looks up the resource the activity created in an earlier attempt in its
+// collection, following the lookup strategy. It returns the url of the resource, or
+// errResourceNotFound.
+func GetResourceIfExists(ctx context.Context, client *resty.Client, serverUrl string, resourceCollectionUrl string,
+	kind ResourceKind, activity *Activity, workflowMetadata WorkflowMetadata) (string, error) {
+	lookup := kind.Lookup
+	if lookup.Strategy == LookupNone {
+		return "", errResourceNotFound
+	}
+	query, err := resolveTemplates(lookup.Query, activity, workflowMetadata)
+	if err != nil {
+		return "", err
+	}
+	match, err := resolveTemplates(lookup.Match, activity, workflowMetadata)
+	if err != nil {
+		return "", err
+	}
+
+	req := client.R().
+		SetContext(ctx).
+		SetQueryParams(query)
+	if lookup.Strategy == "" || lookup.Strategy == LookupHeader {
+		req.SetHeader(lookup.requestIdHeader(), activity.requestId(workflowMetadata))
+	}
+	resp, err := req.Get(resourceCollectionUrl)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode() == http.StatusNotFound {
+		return "", errResourceNotFound
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return "", fmt.Errorf("ResourceGetError: %w", newStatusError(resp))
+	}
+
+	resource := gjson.ParseBytes(resp.Body())
+	// The backend may tell the url of the resource it found, unless it returned a list
+	location := resp.Header().Get("Content-Location")
+	if location == "" {
+		location = resp.Header().Get("Location")
+	}
+	if lookup.Strategy == LookupList {
+		location = ""
+		found := false
+		items := resource
+		if lookup.ItemsPath != "" {
+			items = resource.Get(lookup.ItemsPath)
+		}
+		items.ForEach(func(_, item gjson.Result) bool {
+			for path, value := range match {
+				if item.Get(path).String() != value {
+					return true
+				}
+			}
+			resource = item
+			found = true
+			return false
+		})
+		if !found {
+			return "", errResourceNotFound
+		}
+	}
+	return resourceUrlOf(ctx, activity, kind, serverUrl, resourceCollectionUrl, []byte(resource.Raw), location, workflowMetadata)
+}
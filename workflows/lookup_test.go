@@ -0,0 +1,203 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockResourcesOf counts the resources of the mock stores created by a workflow
+func mockResourcesOf(workflowId string) int {
+	mockStoreLock.Lock()
+	defer mockStoreLock.Unlock()
+	n := 0
+	for _, v := range liveHooksStore {
+		if v.Meta.WorkflowId == workflowId {
+			n++
+		}
+	}
+	for _, v := range mediaStreamToAbrConverterStore {
+		if v.Meta.WorkflowId == workflowId {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLookupPreventsDuplicates(t *testing.T) {
+	defer func(live, mstabr time.Duration) {
+		liveHooksCreateDelay, mediaStreamToAbrConverterCreateDelay = live, mstabr
+	}(liveHooksCreateDelay, mediaStreamToAbrConverterCreateDelay)
+	liveHooksCreateDelay, mediaStreamToAbrConverterCreateDelay = 0, 0
+
+	server := httptest.NewServer(newMockRouter())
+	defer server.Close()
+	activities := NewActivities(&WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL},
+	}})
+
+	tests := []struct {
+		name   string
+		path   string
+		body   map[string]interface{}
+		lookup LookupParams
+	}{
+		{"header", "media_stream_to_abr_converter", map[string]interface{}{"hls_abr_settings": map[string]interface{}{}},
+			LookupParams{}},
+		{"query", "live_hooks", map[string]interface{}{"sender_ip": "10.0.0.1", "sender_port": 1935},
+			LookupParams{Strategy: LookupQuery, Query: map[string]string{
+				"workflow_id":   "{{ workflow.id }}",
+				"activity_name": "{{ activity.name }}",
+			}}},
+		{"list", "live_hooks", map[string]interface{}{"sender_ip": "10.0.0.1", "sender_port": 1935},
+			LookupParams{Strategy: LookupList, ItemsPath: "items", Match: map[string]string{
+				"meta.client_request_id": "{{ activity.request_id }}",
+			}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workflowMetadata := WorkflowMetadata{ID: "lookup-" + tt.name}
+			activity := Activity{}
+			activity.Name = tt.path
+			activity.RequestParams = RequestParams{Path: tt.path, Method: "POST", Body: tt.body}
+			activity.Lookup = tt.lookup
+
+			// The second call is a retry of the activity
+			first, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+			assert.NoError(t, err)
+			retry, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+			assert.NoError(t, err)
+			assert.Equal(t, first.ResourceUrl, retry.ResourceUrl)
+			assert.Equal(t, 1, mockResourcesOf(workflowMetadata.ID))
+		})
+	}
+
+	// Without a lookup every attempt creates a resource
+	workflowMetadata := WorkflowMetadata{ID: "lookup-none"}
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST", Body: tests[1].body}
+	activity.Lookup = LookupParams{Strategy: LookupNone}
+	for i := 0; i < 2; i++ {
+		_, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, mockResourcesOf(workflowMetadata.ID))
+}
+
+func TestLookupLocationOnly(t *testing.T) {
+	// The backend tells the url of the jobs it creates in Location only, their representation
+	// has no id
+	var mu sync.Mutex
+	jobs := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requestId := r.Header.Get(defaultRequestIdHeader)
+		if r.Method == http.MethodGet && r.URL.Query().Has("request_id") {
+			requestId = r.URL.Query().Get("request_id")
+		}
+		switch {
+		case r.Method == http.MethodPost:
+			jobs[requestId] = fmt.Sprintf("/jobs/%d", len(jobs)+1)
+			w.Header().Set("Location", jobs[requestId])
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		case r.URL.Path == "/jobs" && jobs[requestId] == "":
+			http.Error(w, "Not found", http.StatusNotFound)
+		case r.URL.Path == "/jobs" && r.URL.Query().Has("request_id"):
+			fmt.Fprintf(w, `{"status": "ready", "_links": {"self": {"href": %q}}}`, jobs[requestId])
+		case r.URL.Path == "/jobs":
+			w.Header().Set("Content-Location", jobs[requestId])
+			w.Write([]byte(`{"status": "ready"}`))
+		default:
+			w.Write([]byte(`{"status": "ready"}`))
+		}
+	}))
+	defer server.Close()
+	activities := NewActivities(&WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL},
+	}})
+
+	for _, lookup := range []LookupParams{
+		{},
+		{Strategy: LookupQuery, Query: map[string]string{"request_id": "{{ activity.request_id }}"}},
+	} {
+		workflowMetadata := WorkflowMetadata{ID: fmt.Sprintf("location-%d", len(jobs))}
+		activity := Activity{}
+		activity.Name = "job"
+		activity.RequestParams = RequestParams{Path: "jobs", Method: "POST"}
+		activity.Lookup = lookup
+		first, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+		assert.NoError(t, err)
+		// The retry finds the job and its url
+		retry, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, workflowMetadata)
+		assert.NoError(t, err)
+		assert.Equal(t, first.ResourceUrl, retry.ResourceUrl)
+	}
+	assert.Len(t, jobs, 2)
+}
+
+func TestLookupConfig(t *testing.T) {
+	wf, err := ParseWorkflow([]byte(`
+servers:
+  ingest:
+    base_url: http://ingest
+    resources:
+      live_hooks:
+        lookup:
+          strategy: query
+          query:
+            workflow_id: "{{ workflow.id }}"
+activities:
+  - name: live_hooks
+    server: ingest
+    request_params:
+      path: live_hooks
+  - name: mstabr
+    server: ingest
+    request_params:
+      path: media_stream_to_abr_converter
+  - name: mstabr_backup
+    server: ingest
+    request_params:
+      path: live_hooks
+    lookup:
+      strategy: header
+      header: x-client-request-id
+`))
+	assert.NoError(t, err)
+	wfCtxt := CreateWorkflowCtxt(wf)
+	server := wf.Servers["ingest"]
+	lookup := func(name string) LookupParams {
+		return resourceKindFor(GetActivityFromID(wfCtxt.ActivityDag, name), server).Lookup
+	}
+	assert.Equal(t, LookupQuery, lookup("live_hooks").Strategy)
+	assert.Equal(t, LookupParams{Strategy: LookupHeader}, lookup("mstabr"))
+	assert.Equal(t, "x-client-request-id", lookup("mstabr_backup").requestIdHeader())
+
+	for _, c := range []string{
+		"lookup: {strategy: query}",
+		"lookup: {strategy: list}",
+		"lookup: {strategy: scan}",
+	} {
+		_, err := ParseWorkflow([]byte("activities:\n  - name: live_hooks\n    " + c + "\n"))
+		assert.Error(t, err, c)
+	}
+	_, err = ParseWorkflow([]byte("activities:\n  - name: activity\n"))
+	assert.Error(t, err)
+
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	value, err := resolveTemplate("{{ workflow.id }}/{{ activity.name }}", &activity, WorkflowMetadata{ID: "wf"}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "wf/live_hooks", value)
+	_, err = resolveTemplate("{{ mstabr.result.meta.status }}", &activity, WorkflowMetadata{ID: "wf"}, nil)
+	assert.Error(t, err)
+}
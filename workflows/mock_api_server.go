@@ -7,6 +7,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"log"
@@ -20,10 +24,10 @@ type liveHooksReq struct {
 }
 
 type videoParams struct {
-	VvideoWidth          int `json:"video_width",omitempty`
-	VideoHeight          int `json:"video_height",omitempty`
-	FrameRateNumerator   int `json:"frame_rate_numerator",omitempty`
-	FrameRateDenominator int `json:"frame_rate_denominator",omitempty`
+	VvideoWidth          int `json:"video_width,omitempty"`
+	VideoHeight          int `json:"video_height,omitempty"`
+	FrameRateNumerator   int `json:"frame_rate_numerator,omitempty"`
+	FrameRateDenominator int `json:"frame_rate_denominator,omitempty"`
 }
 
 type mediaStreamInputParams struct {
@@ -31,11 +35,12 @@ type mediaStreamInputParams struct {
 }
 
 type Meta struct {
-	ResourceId      string `json:"resource_id",omitempty`
-	ClientRequestId string `json:"client_request_id",omitempty`
-	WorkflowId      string `json:"workflow_id",omitempty`
-	ActivityName    string `json:"activity_name",omitempty`
-	Status          string `json:"status",omitempty`
+	ResourceId      string `json:"resource_id,omitempty"`
+	ClientRequestId string `json:"client_request_id,omitempty"`
+	WorkflowId      string `json:"workflow_id,omitempty"`
+	RunId           string `json:"run_id,omitempty"`
+	ActivityName    string `json:"activity_name,omitempty"`
+	Status          string `json:"status,omitempty"`
 }
 
 type liveHooksResp struct {
@@ -60,6 +65,154 @@ type mediaStreamToAbrConverterResp struct {
 var liveHooksStore = map[string]liveHooksResp{}
 var mediaStreamToAbrConverterStore = map[string]mediaStreamToAbrConverterResp{}
 
+// Time the mock backends take to create resources
+var (
+	liveHooksCreateDelay                 = 5 * time.Second
+	mediaStreamToAbrConverterCreateDelay = 20 * time.Second
+)
+
+// writeList writes a collection as `{"items": [...]}`, sorted by resource id
+func writeList[T any](w http.ResponseWriter, store map[string]T) {
+	ids := []string{}
+	for id := range store {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	items := []T{}
+	for _, id := range ids {
+		items = append(items, store[id])
+	}
+	respBuf, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(respBuf)
+}
+
+// mockOperation is an asynchronous operation creating a resource
+type mockOperation struct {
+	Id               string `json:"id"`
+	Status           string `json:"status"`
+	ResourceLocation string `json:"resource_location,omitempty"`
+}
+
+var mockOperationsStore = map[string]mockOperation{}
+
+// mockAsyncMode makes the mock create every resource asynchronously, as it does for requests
+// with a `Prefer: respond-async` header
+var mockAsyncMode = false
+
+func respondAsync(r *http.Request) bool {
+	return mockAsyncMode || strings.Contains(r.Header.Get("Prefer"), "respond-async")
+}
+
+// startMockOperation runs create after delay and returns the id of the operation tracking it
+func startMockOperation(resourceLocation string, delay time.Duration, create func()) string {
+	operation := mockOperation{Id: randomStringCreate(5), Status: "running"}
+	mockStoreLock.Lock()
+	mockOperationsStore[operation.Id] = operation
+	mockStoreLock.Unlock()
+	go func() {
+		time.Sleep(delay)
+		create()
+		operation.Status = "succeeded"
+		operation.ResourceLocation = resourceLocation
+		mockStoreLock.Lock()
+		mockOperationsStore[operation.Id] = operation
+		mockStoreLock.Unlock()
+	}()
+	return operation.Id
+}
+
+func mockOperationGet(w http.ResponseWriter, r *http.Request) {
+	mockStoreLock.Lock()
+	operation, ok := mockOperationsStore[mux.Vars(r)["id"]]
+	mockStoreLock.Unlock()
+	if !ok {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	respBuf, err := json.Marshal(operation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(respBuf)
+}
+
+// writeCreateResponse answers a create request with the location of the resource and, for
+// asynchronous creation, the location of the operation
+func writeCreateResponse(w http.ResponseWriter, status int, location string, operationId string, resource interface{}) {
+	respBuf, err := json.Marshal(resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", location)
+	if operationId != "" {
+		w.Header().Set("Operation-Location", "/operations/"+operationId)
+	}
+	w.WriteHeader(status)
+	w.Write(respBuf)
+}
+
+// mockStoreLock guards the stores, handlers run concurrently
+var mockStoreLock sync.Mutex
+
+// resourceEvents notifies the event streams of resources about changes of the resources
+type resourceEvents struct {
+	mu       sync.Mutex
+	watchers map[string][]chan interface{}
+}
+
+var mockEvents = resourceEvents{watchers: map[string][]chan interface{}{}}
+
+func (e *resourceEvents) subscribe(key string) (chan interface{}, func()) {
+	ch := make(chan interface{}, 16)
+	e.mu.Lock()
+	e.watchers[key] = append(e.watchers[key], ch)
+	e.mu.Unlock()
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		watchers := e.watchers[key]
+		for i, w := range watchers {
+			if w == ch {
+				e.watchers[key] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (e *resourceEvents) publish(key string, resource interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ch := range e.watchers[key] {
+		select {
+		case ch <- resource:
+		default:
+			// A slow watcher misses the event and falls back to polling once it disconnects
+		}
+	}
+}
+
+func storeLiveHook(resp liveHooksResp) {
+	mockStoreLock.Lock()
+	liveHooksStore[resp.Meta.ResourceId] = resp
+	mockStoreLock.Unlock()
+	mockEvents.publish("live_hooks/"+resp.Meta.ResourceId, resp)
+}
+
+func storeMediaStreamToAbrConverter(resp mediaStreamToAbrConverterResp) {
+	mockStoreLock.Lock()
+	mediaStreamToAbrConverterStore[resp.Meta.ResourceId] = resp
+	mockStoreLock.Unlock()
+	mockEvents.publish("media_stream_to_abr_converter/"+resp.Meta.ResourceId, resp)
+}
+
 func randomStringCreate(len int) string {
 	b := make([]byte, len)
 	rand.Read(b)
@@ -80,18 +233,14 @@ func liveHooksCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get http headers key and values from r
-	headers := make(map[string]string)
-	for k, v := range r.Header {
-		headers[k] = v[0]
-	}
-
 	response := liveHooksResp{}
 
 	// initialize response with some mock data
 	response.Meta.ResourceId = randomStringCreate(5)
-	response.Meta.WorkflowId = headers["x-workflow-id"]
-	response.Meta.ActivityName = headers["x-activity-name"]
+	response.Meta.ClientRequestId = r.Header.Get("x-request-id")
+	response.Meta.WorkflowId = r.Header.Get("x-workflow-id")
+	response.Meta.RunId = r.Header.Get("x-workflow-run-id")
+	response.Meta.ActivityName = r.Header.Get("x-activity-name")
 	response.Meta.Status = "pending"
 	response.MediaStreamInputParams.VideoParams.VvideoWidth = 1920
 	response.MediaStreamInputParams.VideoParams.VideoHeight = 1080
@@ -99,22 +248,25 @@ func liveHooksCreate(w http.ResponseWriter, r *http.Request) {
 	response.MediaStreamInputParams.VideoParams.FrameRateDenominator = 1
 
 	// store response in liveHooksStore
-	liveHooksStore[response.Meta.ResourceId] = response
+	storeLiveHook(response)
+
+	location := "/live_hooks/" + response.Meta.ResourceId
+	if respondAsync(r) {
+		created := response
+		created.Meta.Status = "created"
+		operationId := startMockOperation(location, liveHooksCreateDelay, func() { storeLiveHook(created) })
+		writeCreateResponse(w, http.StatusAccepted, location, operationId, response)
+		return
+	}
 
 	// Simulate live_hook resource creation using sleep
-	time.Sleep(5 * time.Second)
+	time.Sleep(liveHooksCreateDelay)
 
 	response.Meta.Status = "created"
 	// store response in liveHooksStore
-	liveHooksStore[response.Meta.ResourceId] = response
+	storeLiveHook(response)
 
-	// write response to w
-	respBuf, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Write(respBuf)
+	writeCreateResponse(w, http.StatusCreated, location, "", response)
 }
 
 func liveHooksGet(w http.ResponseWriter, r *http.Request) {
@@ -122,7 +274,9 @@ func liveHooksGet(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	resourceId := vars["id"]
 
+	mockStoreLock.Lock()
 	liveHooksResp := liveHooksStore[resourceId]
+	mockStoreLock.Unlock()
 
 	// write response to w
 	respBuf, err := json.Marshal(liveHooksResp)
@@ -145,17 +299,28 @@ func liveHooksGetWithQuery(w http.ResponseWriter, r *http.Request) {
 
 	workflowId := queryParams.Get("workflow_id")
 	activityName := queryParams.Get("activity_name")
+	clientReqId := r.Header.Get("x-request-id")
+	if workflowId == "" && activityName == "" && clientReqId == "" {
+		// Without a query the collection is listed
+		mockStoreLock.Lock()
+		defer mockStoreLock.Unlock()
+		writeList(w, liveHooksStore)
+		return
+	}
 
 	liveHooksResp := liveHooksResp{}
 
 	found_resource := false
+	mockStoreLock.Lock()
 	for _, v := range liveHooksStore {
-		if v.Meta.WorkflowId == workflowId && v.Meta.ActivityName == activityName {
+		if clientReqId != "" && v.Meta.ClientRequestId == clientReqId ||
+			clientReqId == "" && v.Meta.WorkflowId == workflowId && v.Meta.ActivityName == activityName {
 			liveHooksResp = v
 			found_resource = true
 			break
 		}
 	}
+	mockStoreLock.Unlock()
 
 	if !found_resource {
 		http.Error(w, "Resource not found", http.StatusNotFound)
@@ -185,37 +350,36 @@ func mediaStreamToAbrConverterCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get http headers key and values from r
-	headers := make(map[string]string)
-	for k, v := range r.Header {
-		headers[k] = v[0]
-	}
-
 	response := mediaStreamToAbrConverterResp{}
 	response.Meta.ResourceId = randomStringCreate(5)
-	response.Meta.ClientRequestId = headers["x-request-id"]
-	response.Meta.WorkflowId = headers["x-workflow-id"]
-	response.Meta.ActivityName = headers["x-activity-name"]
+	response.Meta.ClientRequestId = r.Header.Get("x-request-id")
+	response.Meta.WorkflowId = r.Header.Get("x-workflow-id")
+	response.Meta.RunId = r.Header.Get("x-workflow-run-id")
+	response.Meta.ActivityName = r.Header.Get("x-activity-name")
 	response.Meta.Status = "pending"
 	response.mediaStreamToAbrConverterReq = req
 
 	// store response in mediaStreamToAbrConverterStore
-	mediaStreamToAbrConverterStore[response.Meta.ResourceId] = response
+	storeMediaStreamToAbrConverter(response)
+
+	location := "/media_stream_to_abr_converter/" + response.Meta.ResourceId
+	if respondAsync(r) {
+		created := response
+		created.Meta.Status = "created"
+		operationId := startMockOperation(location, mediaStreamToAbrConverterCreateDelay,
+			func() { storeMediaStreamToAbrConverter(created) })
+		writeCreateResponse(w, http.StatusAccepted, location, operationId, response)
+		return
+	}
 
 	// Simulate media_stream_to_abr_converter backend resource creation using sleep
-	time.Sleep(20 * time.Second)
+	time.Sleep(mediaStreamToAbrConverterCreateDelay)
 
 	response.Meta.Status = "created"
 
-	mediaStreamToAbrConverterStore[response.Meta.ResourceId] = response
+	storeMediaStreamToAbrConverter(response)
 
-	// write response to w
-	respBuf, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Write(respBuf)
+	writeCreateResponse(w, http.StatusCreated, location, "", response)
 }
 
 func mediaStreamToAbrConverterGet(w http.ResponseWriter, r *http.Request) {
@@ -223,7 +387,9 @@ func mediaStreamToAbrConverterGet(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	resourceId := vars["id"]
 
+	mockStoreLock.Lock()
 	mediaStreamToAbrConverterResp := mediaStreamToAbrConverterStore[resourceId]
+	mockStoreLock.Unlock()
 
 	// write response to w
 	respBuf, err := json.Marshal(mediaStreamToAbrConverterResp)
@@ -237,10 +403,18 @@ func mediaStreamToAbrConverterGet(w http.ResponseWriter, r *http.Request) {
 func mediaStreamToAbrConverterGetWithQuery(w http.ResponseWriter, r *http.Request) {
 	// Get query params from url
 	clientReqId := r.Header.Get("x-request-id")
+	if clientReqId == "" {
+		// Without a request id the collection is listed
+		mockStoreLock.Lock()
+		defer mockStoreLock.Unlock()
+		writeList(w, mediaStreamToAbrConverterStore)
+		return
+	}
 
 	mediaStreamToAbrConverterResp := mediaStreamToAbrConverterResp{}
 
 	found_resource := false
+	mockStoreLock.Lock()
 	for _, v := range mediaStreamToAbrConverterStore {
 		if v.Meta.ClientRequestId == clientReqId {
 			mediaStreamToAbrConverterResp = v
@@ -248,6 +422,7 @@ func mediaStreamToAbrConverterGetWithQuery(w http.ResponseWriter, r *http.Reques
 			break
 		}
 	}
+	mockStoreLock.Unlock()
 
 	if !found_resource {
 		http.Error(w, "Resource not found", http.StatusNotFound)
@@ -263,14 +438,118 @@ func mediaStreamToAbrConverterGetWithQuery(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func initMockServer() {
+// resourceEventStream streams the representation of a resource as Server-Sent Events, first the
+// current one and then every change, until the client disconnects.
+func resourceEventStream(collection string, lookup func(id string) (interface{}, bool)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resourceId := mux.Vars(r)["id"]
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		// Subscribe before reading the current representation so that no change is missed
+		events, unsubscribe := mockEvents.subscribe(collection + "/" + resourceId)
+		defer unsubscribe()
+		resource, found := lookup(resourceId)
+		if !found {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for {
+			respBuf, err := json.Marshal(resource)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", respBuf)
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case resource = <-events:
+			}
+		}
+	}
+}
+
+// Credentials accepted by the mock token endpoint
+const (
+	mockClientId     = "mock-client"
+	mockClientSecret = "mock-secret"
+)
+
+// mockTokenCount counts the tokens issued by the mock token endpoint
+var mockTokenCount int
+
+// oauthToken is a stand-in of an OAuth2 token endpoint supporting the client credentials grant
+func oauthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientId != mockClientId || clientSecret != mockClientSecret {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	mockStoreLock.Lock()
+	mockTokenCount++
+	token := fmt.Sprintf("mock-token-%d", mockTokenCount)
+	mockStoreLock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func newMockRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.HandleFunc("/oauth/token", oauthToken).Methods("POST")
+	router.HandleFunc("/operations/{id}", mockOperationGet).Methods("GET")
 	router.HandleFunc("/live_hooks", liveHooksCreate).Methods("POST")
 	router.HandleFunc("/live_hooks/{id}", liveHooksGet).Methods("GET")
+	router.HandleFunc("/live_hooks/{id}/events", resourceEventStream("live_hooks", func(id string) (interface{}, bool) {
+		mockStoreLock.Lock()
+		defer mockStoreLock.Unlock()
+		resource, ok := liveHooksStore[id]
+		return resource, ok
+	})).Methods("GET")
 	router.HandleFunc("/live_hooks", liveHooksGetWithQuery).Methods("GET")
 	router.HandleFunc("/media_stream_to_abr_converter", mediaStreamToAbrConverterCreate).Methods("POST")
 	router.HandleFunc("/media_stream_to_abr_converter/{id}", mediaStreamToAbrConverterGet).Methods("GET")
+	router.HandleFunc("/media_stream_to_abr_converter/{id}/events", resourceEventStream("media_stream_to_abr_converter",
+		func(id string) (interface{}, bool) {
+			mockStoreLock.Lock()
+			defer mockStoreLock.Unlock()
+			resource, ok := mediaStreamToAbrConverterStore[id]
+			return resource, ok
+		})).Methods("GET")
 	router.HandleFunc("/media_stream_to_abr_converter", mediaStreamToAbrConverterGetWithQuery).Methods("GET")
+	return router
+}
+
+func initMockServer() {
+	mockAsyncMode = os.Getenv("MOCK_ASYNC") != ""
+	router := newMockRouter()
 
 	log.Println("Starting mock server on port 9200")
 
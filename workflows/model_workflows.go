@@ -1,27 +1,178 @@
 package workflows
 
+import (
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
 // Create an enum of workflow types
 type ActivityType string
 type ActivityStatus string
 
+// Types of activities. Activities without a type are API calls.
 const (
-	ApiCall ActivityType = "api_call"
+	ApiCall   ActivityType = "api_call"
+	ApiInvoke ActivityType = "api_invoke"
+	GrpcCall  ActivityType = "grpc_call"
+	GraphQL   ActivityType = "graphql"
+	Script    ActivityType = "script"
+	Wasm      ActivityType = "wasm"
 )
 
 type RequestParams struct {
-	Path   string
-	Method string
-	Body   map[string]interface{}
+	Path   string                 `yaml:"path"`
+	Method string                 `yaml:"method"`
+	Body   map[string]interface{} `yaml:"body"`
+}
+
+// Watch modes of the wait policy of an activity
+const (
+	WaitModePoll     = "poll"
+	WaitModeSSE      = "sse"
+	WaitModeLongPoll = "long_poll"
+)
+
+// WaitParams configures how the resource of an activity is polled until its completeness
+// condition holds. The interval between polls starts at InitialInterval and is multiplied by
+// Multiplier after every poll, up to MaxInterval. Jitter randomizes each interval by up to the
+// given fraction between 0 and 1, e.g. 0.2 for +/-20%. Waiting fails with a
+// ConditionTimeoutError after MaxDuration, which extends the timeout of the activity, see
+// activityOptions; without it waiting is only bounded by the activity timeout.
+//
+// With Mode `sse` or `long_poll` the resource is watched on WatchPath (relative to the resource
+// url) instead, and polled only if the watch fails. See watchResource.
+type WaitParams struct {
+	Mode            string        `yaml:"mode"`
+	WatchPath       string        `yaml:"watch_path"`
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	Multiplier      float64       `yaml:"multiplier"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+	Jitter          float64       `yaml:"jitter"`
+	MaxDuration     time.Duration `yaml:"max_duration"`
 }
 
 type ActivityParams struct {
-	Name                  string
-	Type                  ActivityType
-	RequestParams         RequestParams
-	CompletenessCondition string
+	Name string       `yaml:"name"`
+	Type ActivityType `yaml:"type"`
+	// Server is the name of the server the requests are sent to, DefaultServerName if empty
+	Server                string        `yaml:"server"`
+	RequestParams         RequestParams `yaml:"request_params"`
+	CompletenessCondition string        `yaml:"completeness_condition"`
+	// The activity fails without retries as soon as the failure condition holds for the
+	// resource, e.g. `{{ .result.meta.status }} in ['error', 'failed']`
+	FailureCondition string     `yaml:"failure_condition"`
+	Wait             WaitParams `yaml:"wait"`
+	// Paths of the resource representation kept in the activity result, e.g. `meta.status` or
+	// `hls_abr_settings.variants[0]`. The whole representation is kept when empty.
+	Outputs []string `yaml:"outputs"`
+	// In strict mode a required value expression which cannot be resolved fails the activity
+	// instead of being replaced by null.
+	Strict bool `yaml:"strict"`
+	// Lookup finds the resource created by an earlier attempt of the activity, see LookupParams
+	Lookup LookupParams `yaml:"lookup"`
+	// IdPath, ResourceUrl and Operation override the ones of the resource kind, see ResourceKind
+	IdPath      string           `yaml:"id_path"`
+	ResourceUrl string           `yaml:"resource_url"`
+	Operation   *OperationParams `yaml:"operation"`
+	// IdempotencyKey is a template of the idempotency key of the activity, e.g.
+	// `{{ workflow.id }}/{{ activity.name }}/{{ activity.body_hash }}`, see idempotencyKey
+	IdempotencyKey string `yaml:"idempotency_key"`
+	// Grpc is the method a grpc_call activity invokes, see GrpcParams
+	Grpc GrpcParams `yaml:"grpc"`
+	// GraphQL is the document a graphql activity executes, see GraphQLParams
+	GraphQL GraphQLParams `yaml:"graphql"`
+	// Script is the program of a script activity, see ScriptParams
+	Script ScriptParams `yaml:"script"`
+	// Wasm is the plugin of a wasm activity, see PluginConfig
+	Wasm WasmParams `yaml:"wasm"`
+	// DependsOn are activities the activity depends on in addition to the ones its value
+	// expressions refer to
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// usesServer tells whether the activity sends requests to a server
+func (a *ActivityParams) usesServer() bool {
+	return a.Type != Script && a.Type != Wasm
+}
+
+// validate checks the type of the activity and the parameters it requires
+func (a *ActivityParams) validate() error {
+	switch a.Type {
+	case "", ApiCall, ApiInvoke:
+	case GrpcCall:
+		if a.Grpc.Method == "" {
+			return fmt.Errorf("grpc_call requires grpc.method")
+		}
+		_, _, err := parseGrpcMethod(a.Grpc.Method)
+		if err != nil {
+			return err
+		}
+	case GraphQL:
+		if a.GraphQL.Document == "" {
+			return fmt.Errorf("graphql requires graphql.document")
+		}
+		if a.GraphQL.isMutation() && a.CompletenessCondition != "" {
+			return fmt.Errorf("graphql: a mutation cannot have a completeness condition")
+		}
+	case Script:
+		if a.Script.Source == "" {
+			return fmt.Errorf("script requires script.source")
+		}
+		_, err := a.Script.compile(a.Name)
+		if err != nil {
+			return fmt.Errorf("script: %w", err)
+		}
+	case Wasm:
+		if a.Wasm.Plugin == "" {
+			return fmt.Errorf("wasm requires wasm.plugin")
+		}
+	default:
+		return fmt.Errorf("unknown activity type %q", a.Type)
+	}
+	for _, output := range a.Outputs {
+		_, err := ParsePath(output)
+		if err != nil {
+			return fmt.Errorf("outputs: %w", err)
+		}
+	}
+	err := a.Wait.validate()
+	if err != nil {
+		return err
+	}
+	err = a.validateIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	return a.Lookup.validate()
 }
 
 type Workflow struct {
-	NumActivities int
-	Activities    []ActivityParams
+	NumActivities int `yaml:"-"`
+	// Labels are available to value expressions as `workflow.labels.<key>`
+	Labels map[string]string `yaml:"labels"`
+	// Servers declared by the workflow take precedence over the servers configured in the worker
+	Servers    map[string]ServerConfig `yaml:"servers"`
+	Activities []ActivityParams        `yaml:"activities"`
+}
+
+// ParseWorkflow parses a yaml workflow declaration like testdata/eg_workflow.yaml
+func ParseWorkflow(data []byte) (*Workflow, error) {
+	wf := Workflow{}
+	err := yaml.Unmarshal(data, &wf)
+	if err != nil {
+		return nil, err
+	}
+	for _, activity := range wf.Activities {
+		if activity.Name == WorkflowNamespace || activity.Name == ActivityNamespace {
+			return nil, fmt.Errorf("activity name %q is reserved", activity.Name)
+		}
+		err := activity.validate()
+		if err != nil {
+			return nil, fmt.Errorf("activity %s: %w", activity.Name, err)
+		}
+	}
+	wf.NumActivities = len(wf.Activities)
+	return &wf, nil
 }
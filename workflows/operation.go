@@ -0,0 +1,158 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/tidwall/gjson"
+)
+
+// Defaults of the tracking of asynchronous operations
+const (
+	defaultOperationHeader          = "Operation-Location"
+	defaultOperationStatusPath      = "status"
+	defaultOperationResourceUrlPath = "resource_location"
+)
+
+var (
+	defaultOperationSucceeded = []string{"succeeded", "completed", "done"}
+	defaultOperationFailed    = []string{"failed", "canceled", "cancelled"}
+)
+
+// OperationParams configures how the asynchronous operation creating a resource is tracked.
+// When the backend accepts a create request with `202 Accepted` and a status monitor url in
+// Header (Operation-Location by default, set it to Location for backends returning the monitor
+// there), the monitor is polled until the status at StatusPath is one of Succeeded or Failed.
+// The url of the created resource is then the Location of the create response, or the Location
+// of the last monitor response, or the url at ResourceUrlPath in it. A monitor redirecting to
+// the resource when the operation completes is supported as well. Polling follows the wait
+// policy of the activity, and Retry-After headers of the monitor. An operation which is not
+// complete after the MaxDuration of the wait policy fails with a ConditionTimeoutError.
+type OperationParams struct {
+	Header          string   `yaml:"header"`
+	StatusPath      string   `yaml:"status_path"`
+	Succeeded       []string `yaml:"succeeded"`
+	Failed          []string `yaml:"failed"`
+	ResourceUrlPath string   `yaml:"resource_url_path"`
+}
+
+func (o OperationParams) withDefaults() OperationParams {
+	if o.Header == "" {
+		o.Header = defaultOperationHeader
+	}
+	if o.StatusPath == "" {
+		o.StatusPath = defaultOperationStatusPath
+	}
+	if len(o.Succeeded) == 0 {
+		o.Succeeded = defaultOperationSucceeded
+	}
+	if len(o.Failed) == 0 {
+		o.Failed = defaultOperationFailed
+	}
+	if o.ResourceUrlPath == "" {
+		o.ResourceUrlPath = defaultOperationResourceUrlPath
+	}
+	return o
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForOperation polls the status monitor of an asynchronous operation until the operation
+// completes. It returns the url of the created resource, if the monitor reports it, and the
+// last representation of the monitor. A failed operation fails with a non retryable
+// OperationFailedError, and an operation which does not complete within the MaxDuration of the
+// wait policy with a non retryable ConditionTimeoutError.
+func waitForOperation(ctx context.Context, client *resty.Client, activity *Activity, operation OperationParams,
+	operationUrl string) (string, []byte, error) {
+	defer heartbeat(ctx)()
+	operation = operation.withDefaults()
+	wait := activity.Wait.withDefaults()
+	interval := wait.InitialInterval
+	start := time.Now()
+	for {
+		resp, err := client.R().SetContext(ctx).Get(operationUrl)
+		if err != nil {
+			return "", nil, fmt.Errorf("OperationError: %w", err)
+		}
+		if !resp.IsSuccess() {
+			return "", nil, fmt.Errorf("OperationError: %w", newStatusError(resp))
+		}
+		finalUrl := resp.RawResponse.Request.URL
+		if finalUrl.String() != operationUrl {
+			// The monitor redirected to the created resource
+			return finalUrl.String(), resp.Body(), nil
+		}
+
+		status := gjson.GetBytes(resp.Body(), operation.StatusPath).String()
+		if containsFold(operation.Failed, status) {
+			return "", nil, newOperationFailedError(ctx, activity.Name, operationUrl, status, resp.Body())
+		}
+		if containsFold(operation.Succeeded, status) {
+			location := resp.Header().Get("Location")
+			if location == "" {
+				location = gjson.GetBytes(resp.Body(), operation.ResourceUrlPath).String()
+			}
+			if location != "" {
+				resourceUrl, err := finalUrl.Parse(location)
+				if err != nil {
+					return "", nil, fmt.Errorf("OperationError: invalid resource location %q: %w", location, err)
+				}
+				location = resourceUrl.String()
+			}
+			return location, resp.Body(), nil
+		}
+
+		sleepTime, ok := retryAfter(resp.Header())
+		if !ok {
+			sleepTime = wait.jittered(interval)
+			interval = time.Duration(float64(interval) * wait.Multiplier)
+			if interval > wait.MaxInterval {
+				interval = wait.MaxInterval
+			}
+		}
+		if wait.MaxDuration > 0 {
+			remaining := wait.MaxDuration - time.Since(start)
+			if remaining <= 0 {
+				return "", nil, newOperationTimeoutError(ctx, activity, operationUrl, time.Since(start),
+					operation.StatusPath, status)
+			}
+			if sleepTime > remaining {
+				sleepTime = remaining
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", nil, ctx.Err()
+		case <-time.After(sleepTime):
+		}
+	}
+}
+
+// operationUrlOf returns the url of the status monitor of a create response, if the backend
+// accepted the request for asynchronous processing.
+func operationUrlOf(resp *resty.Response, operation OperationParams) (string, error) {
+	if resp.StatusCode() != http.StatusAccepted {
+		return "", nil
+	}
+	monitor := resp.Header().Get(operation.withDefaults().Header)
+	if monitor == "" {
+		return "", nil
+	}
+	base := resp.RawResponse.Request.URL
+	operationUrl, err := base.Parse(monitor)
+	if err != nil {
+		return "", fmt.Errorf("OperationError: invalid operation location %q: %w", monitor, err)
+	}
+	return operationUrl.String(), nil
+}
@@ -0,0 +1,118 @@
+package workflows
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestAsyncCreate(t *testing.T) {
+	defer func(delay time.Duration) { liveHooksCreateDelay = delay }(liveHooksCreateDelay)
+	liveHooksCreateDelay = 200 * time.Millisecond
+
+	server := httptest.NewServer(newMockRouter())
+	defer server.Close()
+	activities := NewActivities(&WorkerConfig{Servers: map[string]ServerConfig{
+		DefaultServerName: {BaseUrl: server.URL, Headers: map[string]string{"Prefer": "respond-async"}},
+	}})
+
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.RequestParams = RequestParams{Path: "live_hooks", Method: "POST",
+		Body: map[string]interface{}{"sender_ip": "10.0.0.1", "sender_port": 1935}}
+	activity.Wait = WaitParams{InitialInterval: 20 * time.Millisecond}
+
+	start := time.Now()
+	result, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, WorkflowMetadata{ID: "async-create"})
+	assert.NoError(t, err)
+	// Without a completeness condition the resource is complete once the operation succeeded
+	assert.GreaterOrEqual(t, time.Since(start), liveHooksCreateDelay)
+	assert.Equal(t, "created", result.Result["meta"].(map[string]interface{})["status"])
+	assert.True(t, strings.HasPrefix(result.ResourceUrl, server.URL+"/live_hooks/"), result.ResourceUrl)
+}
+
+func TestWaitForOperation(t *testing.T) {
+	var polls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hooks":
+			w.Header().Set("Location", "/monitors/1")
+			w.WriteHeader(http.StatusAccepted)
+		case "/streams":
+			w.Header().Set("Operation-Location", "/operations/2")
+			w.WriteHeader(http.StatusAccepted)
+		case "/monitors/1":
+			if polls.Add(1) < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.Write([]byte(`{"state": "Running"}`))
+				return
+			}
+			http.Redirect(w, r, "/hooks/h1", http.StatusSeeOther)
+		case "/hooks/h1":
+			w.Write([]byte(`{"id": "h1"}`))
+		case "/operations/2":
+			w.Write([]byte(`{"status": "Failed", "error": {"message": "no capacity"}}`))
+		}
+	}))
+	defer server.Close()
+
+	activity := Activity{}
+	activity.Name = "hooks"
+	activity.Wait = WaitParams{InitialInterval: time.Minute}
+	kind := ResourceKind{Operation: OperationParams{Header: "Location", StatusPath: "state"}}
+	resourceUrl, err := createResource(context.Background(), testClient(t), &activity, kind, server.URL,
+		server.URL+"/hooks", WorkflowMetadata{ID: "wf"}, []byte(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/hooks/h1", resourceUrl)
+	assert.Equal(t, int32(3), polls.Load())
+
+	activity.Name = "streams"
+	_, err = createResource(context.Background(), testClient(t), &activity, ResourceKind{}, server.URL,
+		server.URL+"/streams", WorkflowMetadata{ID: "wf"}, []byte(`{}`))
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, OperationFailedError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+	var details OperationFailedDetails
+	assert.NoError(t, appErr.Details(&details))
+	assert.Equal(t, server.URL+"/operations/2", details.OperationUrl)
+	assert.Contains(t, details.Operation, "no capacity")
+}
+
+func TestWaitForOperationTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hooks" {
+			w.Header().Set("Operation-Location", "/operations/1")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		// The operation never completes
+		w.Header().Set("Retry-After", "60")
+		w.Write([]byte(`{"status": "running"}`))
+	}))
+	defer server.Close()
+
+	activity := Activity{}
+	activity.Name = "hooks"
+	activity.Wait = WaitParams{InitialInterval: 10 * time.Millisecond, MaxDuration: 100 * time.Millisecond}
+	start := time.Now()
+	_, err := createResource(context.Background(), testClient(t), &activity, ResourceKind{}, server.URL,
+		server.URL+"/hooks", WorkflowMetadata{ID: "wf"}, []byte(`{}`))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	var appErr *temporal.ApplicationError
+	if assert.ErrorAs(t, err, &appErr) {
+		assert.Equal(t, ConditionTimeoutError, appErr.Type())
+		assert.True(t, appErr.NonRetryable())
+		var details ConditionTimeoutDetails
+		assert.NoError(t, appErr.Details(&details))
+		assert.Equal(t, server.URL+"/operations/1", details.ResourceUrl)
+		assert.Equal(t, map[string]interface{}{"status": "running"}, details.LastValues)
+	}
+}
@@ -0,0 +1,188 @@
+package workflows
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PathSegment is one step of a Path, either a key into an object or an index into a list.
+// An Optional segment (written with a `?` suffix) may be missing, see ValueExpression.
+type PathSegment struct {
+	Key      string
+	Index    int
+	IsIndex  bool
+	Optional bool
+}
+
+// Path locates a value inside the nested maps and slices decoded from json or yaml. It is
+// shared by value expression discovery (FindPathAndValuesWithPattern) and substitution
+// (ResolveValueExpressions). A path is rendered as `key7[1].key3`, or as the json pointer
+// `/key7/1/key3`.
+type Path []PathSegment
+
+// Key returns a copy of the path extended with an object key
+func (p Path) Key(key string) Path {
+	return p.append(PathSegment{Key: key})
+}
+
+// Index returns a copy of the path extended with a list index
+func (p Path) Index(index int) Path {
+	return p.append(PathSegment{Index: index, IsIndex: true})
+}
+
+func (p Path) append(segment PathSegment) Path {
+	out := make(Path, len(p), len(p)+1)
+	copy(out, p)
+	return append(out, segment)
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+	for i, segment := range p {
+		if segment.IsIndex {
+			fmt.Fprintf(&sb, "[%d]", segment.Index)
+		} else {
+			if i > 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString(segment.Key)
+		}
+		if segment.Optional {
+			sb.WriteString("?")
+		}
+	}
+	return sb.String()
+}
+
+// Pointer renders the path as a json pointer (RFC 6901)
+func (p Path) Pointer() string {
+	var sb strings.Builder
+	for _, segment := range p {
+		sb.WriteString("/")
+		if segment.IsIndex {
+			sb.WriteString(strconv.Itoa(segment.Index))
+		} else {
+			sb.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(segment.Key))
+		}
+	}
+	return sb.String()
+}
+
+// ParsePath parses paths like `foo.bar[1].baz`, `foo[0][2]` or `foo.bar.1.baz`. A numeric
+// key like `1` is kept as a key and used as an index when it is applied to a list. A `?`
+// after a key or index marks the segment as optional, e.g. `foo.bar?.baz`.
+func ParsePath(s string) (Path, error) {
+	path := Path{}
+	if s == "" {
+		return path, nil
+	}
+	for _, part := range strings.Split(s, ".") {
+		key := part
+		rest := ""
+		if i := strings.Index(part, "["); i >= 0 {
+			key, rest = part[:i], part[i:]
+		}
+		optional := strings.HasSuffix(key, "?")
+		key = strings.TrimSuffix(key, "?")
+		if key == "" && (rest == "" || len(path) == 0 || optional) {
+			return nil, fmt.Errorf("InvalidPath: empty key in %q", s)
+		}
+		if key != "" {
+			path = path.append(PathSegment{Key: key, Optional: optional})
+		}
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("InvalidPath: malformed index in %q", s)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("InvalidPath: malformed index in %q", s)
+			}
+			rest = rest[end+1:]
+			optional := strings.HasPrefix(rest, "?")
+			rest = strings.TrimPrefix(rest, "?")
+			path = path.append(PathSegment{Index: index, IsIndex: true, Optional: optional})
+		}
+	}
+	return path, nil
+}
+
+// PathNotFoundError is returned when a path does not exist in an object. Missing is the
+// prefix of the path up to and including the first segment that could not be followed.
+type PathNotFoundError struct {
+	Path    Path
+	Missing Path
+}
+
+func (e *PathNotFoundError) Error() string {
+	return fmt.Sprintf("PathNotFound: %s (missing %s)", e.Path, e.Missing)
+}
+
+// step follows one segment of the path from obj
+func step(obj interface{}, segment PathSegment) (interface{}, bool) {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		if segment.IsIndex {
+			return nil, false
+		}
+		v, ok := o[segment.Key]
+		return v, ok
+	case []interface{}:
+		index := segment.Index
+		if !segment.IsIndex {
+			i, err := strconv.Atoi(segment.Key)
+			if err != nil {
+				return nil, false
+			}
+			index = i
+		}
+		if index < 0 || index >= len(o) {
+			return nil, false
+		}
+		return o[index], true
+	}
+	return nil, false
+}
+
+// Get returns the value at the path
+func (p Path) Get(obj interface{}) (interface{}, error) {
+	for i, segment := range p {
+		next, ok := step(obj, segment)
+		if !ok {
+			return nil, &PathNotFoundError{Path: p, Missing: p[:i+1]}
+		}
+		obj = next
+	}
+	return obj, nil
+}
+
+// Set replaces the value at the path. All but the last segment must already exist.
+func (p Path) Set(obj interface{}, value interface{}) error {
+	if len(p) == 0 {
+		return fmt.Errorf("InvalidPath: cannot set the root of an object")
+	}
+	parent, err := p[:len(p)-1].Get(obj)
+	if err != nil {
+		return err
+	}
+	last := p[len(p)-1]
+	switch o := parent.(type) {
+	case map[string]interface{}:
+		if !last.IsIndex {
+			o[last.Key] = value
+			return nil
+		}
+	case []interface{}:
+		if _, ok := step(o, last); ok {
+			index := last.Index
+			if !last.IsIndex {
+				index, _ = strconv.Atoi(last.Key)
+			}
+			o[index] = value
+			return nil
+		}
+	}
+	return &PathNotFoundError{Path: p, Missing: p}
+}
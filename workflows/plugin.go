@@ -0,0 +1,316 @@
+package workflows
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// Defaults of the limits of plugins
+const (
+	defaultPluginMemoryLimitMB = 128
+	defaultPluginOutputLimitMB = 1
+	defaultPluginTimeout       = 10 * time.Second
+)
+
+// wasmPageSize is the size of a page of WebAssembly memory
+const wasmPageSize = 64 * 1024
+
+// PluginConfig is a WebAssembly module which wasm activities run, see WasmParams. The module
+// is a WASI command, e.g. built with `GOOS=wasip1 GOARCH=wasm go build`, which reads its input
+// as JSON on stdin and writes its output as JSON to stdout, see pluginInput. It has no access to
+// the file system, the network, the environment or the clocks.
+//
+// The memory of the module is limited to MemoryLimitMB (128 by default), what it writes to
+// stdout and to stderr to OutputLimitMB each (1 by default) and every run to Timeout (10s by
+// default). The module is reloaded when the file at Path changes, so that a plugin can be
+// updated without restarting the worker.
+type PluginConfig struct {
+	Path          string        `yaml:"path"`
+	MemoryLimitMB uint32        `yaml:"memory_limit_mb"`
+	OutputLimitMB uint32        `yaml:"output_limit_mb"`
+	Timeout       time.Duration `yaml:"timeout"`
+}
+
+func (p PluginConfig) withDefaults() PluginConfig {
+	if p.MemoryLimitMB == 0 {
+		p.MemoryLimitMB = defaultPluginMemoryLimitMB
+	}
+	if p.OutputLimitMB == 0 {
+		p.OutputLimitMB = defaultPluginOutputLimitMB
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultPluginTimeout
+	}
+	return p
+}
+
+func (p PluginConfig) validate() error {
+	if p.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	return nil
+}
+
+// WasmParams names the plugin a wasm activity runs, one of the plugins of the worker
+type WasmParams struct {
+	Plugin string `yaml:"plugin"`
+}
+
+// pluginInput is what a plugin reads on stdin. Inputs is the resolved request body of the
+// activity and Results are the results of its dependencies by name, as
+// `{"result": ..., "request": ...}`. A JSON object written to stdout is the result of the
+// activity, and any other JSON value the `value` of the result.
+type pluginInput struct {
+	Activity string                 `json:"activity"`
+	Inputs   map[string]interface{} `json:"inputs"`
+	Results  map[string]interface{} `json:"results"`
+}
+
+// pluginModule is a version of the module of a plugin, compiled by its own runtime
+type pluginModule struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	modTime  time.Time
+	size     int64
+	// runs counts the runs of the module, which is closed after the last one once it has been
+	// reloaded
+	runs sync.WaitGroup
+}
+
+func (m *pluginModule) close() {
+	m.runs.Wait()
+	m.runtime.Close(context.Background())
+}
+
+// current tells whether the module was compiled from the file described by info
+func (m *pluginModule) current(info os.FileInfo) bool {
+	return m.modTime.Equal(info.ModTime()) && m.size == info.Size()
+}
+
+// pluginRegistry keeps the modules of the plugins of a worker, compiled on first use and
+// reloaded when their files change
+type pluginRegistry struct {
+	config *WorkerConfig
+
+	mu      sync.Mutex
+	modules map[string]*pluginModule
+	loads   map[string]*pluginLoad
+}
+
+// pluginLoad is the load of the module of a plugin in flight
+type pluginLoad struct {
+	done chan struct{}
+	err  error
+	// cancelled tells that the activity loading the module was cancelled, which does not fail
+	// the activities waiting for the module
+	cancelled bool
+}
+
+func newPluginRegistry(cfg *WorkerConfig) *pluginRegistry {
+	return &pluginRegistry{config: cfg, modules: map[string]*pluginModule{}, loads: map[string]*pluginLoad{}}
+}
+
+// acquire returns the current module of a plugin, reloading it if its file changed. The module
+// is compiled outside of the lock of the registry, so that loading a plugin does not hold up
+// the runs of the others, and only once at a time for a plugin. The module must be released
+// after running it.
+func (r *pluginRegistry) acquire(ctx context.Context, name string, plugin PluginConfig) (*pluginModule, error) {
+	info, err := os.Stat(plugin.Path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		r.mu.Lock()
+		module, ok := r.modules[name]
+		if ok && module.current(info) {
+			module.runs.Add(1)
+			r.mu.Unlock()
+			return module, nil
+		}
+		load, ok := r.loads[name]
+		if !ok {
+			load = &pluginLoad{done: make(chan struct{})}
+			r.loads[name] = load
+			r.mu.Unlock()
+			return r.load(ctx, name, plugin, info, load)
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-load.done:
+		}
+		if load.err != nil && !load.cancelled {
+			return nil, load.err
+		}
+	}
+}
+
+// load compiles the module of a plugin and swaps it in for the previous one, which is closed
+// after its last run
+func (r *pluginRegistry) load(ctx context.Context, name string, plugin PluginConfig, info os.FileInfo,
+	load *pluginLoad) (*pluginModule, error) {
+	module, err := loadPluginModule(ctx, plugin, info)
+	r.mu.Lock()
+	if err == nil {
+		if previous, ok := r.modules[name]; ok {
+			log.Printf("plugin %s: reloaded %s", name, plugin.Path)
+			go previous.close()
+		}
+		r.modules[name] = module
+		module.runs.Add(1)
+	}
+	load.err = err
+	load.cancelled = ctx.Err() != nil
+	delete(r.loads, name)
+	r.mu.Unlock()
+	close(load.done)
+	return module, err
+}
+
+func loadPluginModule(ctx context.Context, plugin PluginConfig, info os.FileInfo) (*pluginModule, error) {
+	code, err := os.ReadFile(plugin.Path)
+	if err != nil {
+		return nil, err
+	}
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(plugin.MemoryLimitMB * (1024 * 1024 / wasmPageSize)).
+		WithCloseOnContextDone(true)
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("%s: %w", plugin.Path, err)
+	}
+	return &pluginModule{runtime: runtime, compiled: compiled, modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// errOutputLimit is returned to a plugin writing past the output limit
+var errOutputLimit = errors.New("output limit exceeded")
+
+// limitedWriter keeps what is written to it up to limit bytes. The memory limit of a plugin only
+// bounds its own memory, not what the worker keeps of its output. A write past the limit fails
+// and calls exceeded to stop the plugin.
+type limitedWriter struct {
+	buf      bytes.Buffer
+	limit    int
+	exceeded func()
+	overflow bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		w.overflow = true
+		w.exceeded()
+		return 0, errOutputLimit
+	}
+	return w.buf.Write(p)
+}
+
+// run runs the module with input on stdin and returns what it wrote to stdout and stderr. The run
+// fails once the module writes more than limit bytes to either.
+func (m *pluginModule) run(ctx context.Context, input []byte, limit int) ([]byte, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stdout := &limitedWriter{limit: limit, exceeded: cancel}
+	stderr := &limitedWriter{limit: limit, exceeded: cancel}
+	config := wazero.NewModuleConfig().
+		WithName("").
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(stdout).
+		WithStderr(stderr)
+	module, err := m.runtime.InstantiateModule(ctx, m.compiled, config)
+	if module != nil {
+		module.Close(ctx)
+	}
+	if stdout.overflow || stderr.overflow {
+		err = errOutputLimit
+	}
+	return stdout.buf.Bytes(), stderr.buf.Bytes(), err
+}
+
+// runPlugin runs the plugin of an activity with its inputs and the results of its dependencies
+func (r *pluginRegistry) runPlugin(ctx context.Context, activity *Activity, inputs map[string]interface{},
+	results map[string]ActivityResult) (map[string]interface{}, error) {
+	plugin, ok := r.config.Plugins[activity.Wasm.Plugin]
+	if !ok {
+		return nil, newUnknownPluginError(activity.Name, activity.Wasm.Plugin)
+	}
+	plugin = plugin.withDefaults()
+	input, err := json.Marshal(pluginInput{Activity: activity.Name, Inputs: inputs, Results: dependencyObjects(results)})
+	if err != nil {
+		return nil, newRequestMarshalError(activity.Name, err)
+	}
+	module, err := r.acquire(ctx, activity.Wasm.Plugin, plugin)
+	if err != nil {
+		// The plugin may be fixed while the activity is retried
+		return nil, activityError("PluginLoadError", fmt.Errorf("plugin %s: %w", activity.Wasm.Plugin, err))
+	}
+	defer module.runs.Done()
+
+	runCtx, cancel := context.WithTimeout(ctx, plugin.Timeout)
+	defer cancel()
+	stdout, stderr, err := module.run(runCtx, input, int(plugin.OutputLimitMB)<<20)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == sys.ExitCodeDeadlineExceeded {
+		err = fmt.Errorf("time limit of %s exceeded", plugin.Timeout)
+	} else if errors.Is(err, errOutputLimit) {
+		err = fmt.Errorf("output limit of %d MB exceeded", plugin.OutputLimitMB)
+	}
+	if err != nil {
+		return nil, newPluginError(activity.Name, activity.Wasm.Plugin, err, stderr)
+	}
+	var output interface{}
+	err = json.Unmarshal(stdout, &output)
+	if err != nil {
+		return nil, newPluginError(activity.Name, activity.Wasm.Plugin,
+			fmt.Errorf("output is not JSON: %w: %s", err, excerpt(stdout)), stderr)
+	}
+	if len(stderr) > 0 {
+		log.Printf("%s: plugin %s: %s", activity.Name, activity.Wasm.Plugin, strings.TrimSpace(string(stderr)))
+	}
+	return resultObject(output), nil
+}
+
+// WasmActivity runs the plugin of a wasm activity, see PluginConfig. The results of the
+// activities it depends on, through value expressions or DependsOn, are passed to the plugin.
+func (a *Activities) WasmActivity(ctx context.Context, activity *Activity,
+	activityResults map[string]ActivityResult, workflowMetadata WorkflowMetadata) (ActivityResult, error) {
+
+	dependencies := dependencyResults(activity, activityResults)
+	_, err := resolveRequestBody(activity, activityResults, workflowMetadata)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	result, err := a.plugins.runPlugin(ctx, activity, activity.RequestParams.Body, dependencies)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+
+	return ActivityResult{
+		Result:         ProjectOutputs(result, activity.Outputs),
+		Request:        activity.RequestParams.Body,
+		IdempotencyKey: activity.key,
+	}, nil
+}
@@ -0,0 +1,142 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+// buildLadderPlugin builds the example plugin of testdata/plugins/ladder
+func buildLadderPlugin(t *testing.T, version string, path string) {
+	t.Helper()
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool is needed to build the example plugin")
+	}
+	cmd := exec.Command(goTool, "build", "-o", path, "-ldflags", "-X main.version="+version, "./testdata/plugins/ladder")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("building the example plugin: %v: %s", err, output)
+	}
+}
+
+func wasmActivity(plugin string, body map[string]interface{}) *Activity {
+	activity := &Activity{}
+	activity.Name = "ladder"
+	activity.Type = Wasm
+	activity.Wasm = WasmParams{Plugin: plugin}
+	activity.DependsOn = []string{"live_hooks"}
+	activity.RequestParams = RequestParams{Body: body}
+	return activity
+}
+
+func TestWasmPlugin(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ladder.wasm")
+	buildLadderPlugin(t, "1", path)
+
+	cfg, err := ParseWorkerConfig([]byte(`
+plugins:
+  ladder:
+    path: ` + path + `
+  limited:
+    path: ` + path + `
+    memory_limit_mb: 64
+    output_limit_mb: 1
+    timeout: 500ms
+`))
+	assert.NoError(t, err)
+	activities := NewActivities(cfg)
+	workflowMetadata := WorkflowMetadata{ID: "wf-1", RunID: "run-1"}
+	activityResults := map[string]ActivityResult{
+		"live_hooks": {Result: map[string]interface{}{"video_height": 720.0}},
+	}
+	ladder := []interface{}{
+		map[string]interface{}{"height": 1080, "bitrate": 6000},
+		map[string]interface{}{"height": 720, "bitrate": 3000},
+	}
+	variants := []interface{}{map[string]interface{}{"height": 720.0, "bitrate": 3000.0}}
+
+	result, err := activities.WasmActivity(context.Background(), wasmActivity("ladder",
+		map[string]interface{}{"ladder": ladder}), activityResults, workflowMetadata)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"variants": variants, "version": "1"}, result.Result)
+	}
+
+	assertFails := func(activity *Activity, errType string, message string) *temporal.ApplicationError {
+		t.Helper()
+		_, err := activities.WasmActivity(context.Background(), activity, activityResults, workflowMetadata)
+		var appErr *temporal.ApplicationError
+		if assert.True(t, errors.As(err, &appErr), "%v", err) {
+			assert.Equal(t, errType, appErr.Type())
+			assert.True(t, appErr.NonRetryable())
+			assert.ErrorContains(t, err, message)
+		}
+		return appErr
+	}
+	missing := wasmActivity("ladder", map[string]interface{}{"ladder": ladder})
+	missing.DependsOn = nil
+	appErr := assertFails(missing, PluginError, "exit_code(2)")
+	var details PluginErrorDetails
+	if assert.NotNil(t, appErr) && assert.NoError(t, appErr.Details(&details)) {
+		assert.Contains(t, details.Stderr, "must depend on live_hooks")
+	}
+	assertFails(wasmActivity("limited", map[string]interface{}{"spin": true}), PluginError, "time limit of 500ms")
+	appErr = assertFails(wasmActivity("limited", map[string]interface{}{"allocate_mb": 256}), PluginError, "exit_code")
+	if assert.NotNil(t, appErr) && assert.NoError(t, appErr.Details(&details)) {
+		assert.Contains(t, details.Stderr, "out of memory")
+	}
+	// The plugin is stopped when it writes past the output limit, not by the time limit
+	start := time.Now()
+	assertFails(wasmActivity("limited", map[string]interface{}{"flood": true}), PluginError, "output limit of 1 MB")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assertFails(wasmActivity("converter", nil), UnknownPluginError, "not configured")
+
+	// The plugin is reloaded when its file changes
+	updated := filepath.Join(dir, "ladder-2.wasm")
+	buildLadderPlugin(t, "2", updated)
+	assert.NoError(t, os.Rename(updated, path))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, later, later))
+	result, err = activities.WasmActivity(context.Background(), wasmActivity("ladder",
+		map[string]interface{}{"ladder": ladder}), activityResults, workflowMetadata)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2", result.Result["version"])
+	}
+}
+
+func TestParseWasmWorkflow(t *testing.T) {
+	wf, err := ParseWorkflow([]byte(`
+activities:
+  - name: ladder
+    type: wasm
+    depends_on: [live_hooks]
+    wasm:
+      plugin: ladder
+`))
+	if assert.NoError(t, err) {
+		assert.NoError(t, ValidateWorkflow(wf, &WorkerConfig{Plugins: map[string]PluginConfig{
+			"ladder": {Path: "ladder.wasm"}}}))
+		assert.ErrorContains(t, ValidateWorkflow(wf, &WorkerConfig{}), "plugin ladder is not configured")
+	}
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: ladder
+    type: wasm
+`))
+	assert.ErrorContains(t, err, "wasm.plugin")
+	_, err = ParseWorkerConfig([]byte(`
+plugins:
+  ladder:
+    memory_limit_mb: 64
+`))
+	assert.ErrorContains(t, err, "path")
+}
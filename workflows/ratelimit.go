@@ -0,0 +1,155 @@
+package workflows
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig limits the requests of the worker to the host of a server with a token
+// bucket: Rate requests per second on average, in bursts of up to Burst requests (by default
+// the rate rounded up). The limit is shared by all activities of the worker, and by all
+// servers on the same host, where the first server used sets the limit.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (r RateLimitConfig) validate() error {
+	if r.Rate < 0 || r.Burst < 0 {
+		return fmt.Errorf("rate_limit: rate and burst must not be negative")
+	}
+	return nil
+}
+
+func (r RateLimitConfig) limiter() *rate.Limiter {
+	burst := r.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(r.Rate))
+	}
+	return rate.NewLimiter(rate.Limit(r.Rate), burst)
+}
+
+// RetryLaterError fails a request which would have to wait longer than its activity can,
+// either for the Retry-After of a response or for the rate limit of the worker. Its activity
+// fails with a RateLimitedError which the workflow retries after Delay.
+type RetryLaterError struct {
+	Method string
+	Url    string
+	// StatusCode and Body are the ones of the response asking to retry later, if any
+	StatusCode int
+	Body       []byte
+	Delay      time.Duration
+}
+
+func (e *RetryLaterError) Error() string {
+	if e.StatusCode == 0 {
+		return fmt.Sprintf("%s %s: rate limit of the worker exceeded, retry after %s", e.Method, e.Url, e.Delay)
+	}
+	return fmt.Sprintf("%s %s: %d %s, retry after %s", e.Method, e.Url, e.StatusCode,
+		http.StatusText(e.StatusCode), e.Delay)
+}
+
+// rateLimitTransport waits for the rate limit of the host before sending a request. A request
+// which cannot be sent before the deadline of its context fails right away with a
+// RetryLaterError.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	reservation := t.limiter.Reserve()
+	delay := reservation.Delay()
+	if delay > 0 {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			reservation.Cancel()
+			return nil, &RetryLaterError{Method: req.Method, Url: req.URL.String(), Delay: delay}
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			reservation.Cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// retryAfter returns the delay a response asks for in its Retry-After header, either in
+// seconds or as an http date.
+func retryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// retryCondition retries rate limited and unavailable responses. Requests failing without a
+// response are retried too, except creates, which the activity retries after looking up the
+// resource, and requests which have to wait for the rate limit or the circuit breaker of their
+// host, which the workflow retries.
+func retryCondition(r *resty.Response, err error) bool {
+	var retryLater *RetryLaterError
+	var openCircuit *OpenCircuitError
+	if errors.As(err, &retryLater) || errors.As(err, &openCircuit) {
+		return false
+	}
+	if err != nil {
+		return r == nil || r.Request == nil || r.Request.Method != http.MethodPost
+	}
+	return r.StatusCode() == http.StatusTooManyRequests || r.StatusCode() == http.StatusServiceUnavailable
+}
+
+// retryAfterFunc waits for the Retry-After of a response before retrying the request, falling
+// back to the backoff of the client. A delay longer than maxWait or than the activity has left
+// fails the request with a RetryLaterError instead.
+func retryAfterFunc(maxWait time.Duration) resty.RetryAfterFunc {
+	return func(_ *resty.Client, resp *resty.Response) (time.Duration, error) {
+		delay, ok := retryAfter(resp.Header())
+		if !ok || delay <= 0 {
+			return 0, nil
+		}
+		remaining := maxWait
+		if deadline, ok := resp.Request.Context().Deadline(); ok && time.Until(deadline) < remaining {
+			remaining = time.Until(deadline)
+		}
+		if delay > remaining {
+			return 0, &RetryLaterError{
+				Method:     resp.Request.Method,
+				Url:        resp.Request.URL,
+				StatusCode: resp.StatusCode(),
+				Body:       resp.Body(),
+				Delay:      delay,
+			}
+		}
+		return delay, nil
+	}
+}
+
+// hostOf returns the host whose rate limit and circuit breaker apply to the requests to a
+// server
+func hostOf(baseUrl string) string {
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return baseUrl
+	}
+	return u.Host
+}
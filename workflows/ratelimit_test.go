@@ -0,0 +1,139 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestRateLimit(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	cfg, err := ParseWorkerConfig([]byte(`
+servers:
+  ingest:
+    base_url: ` + server.URL + `/ingest
+    rate_limit:
+      rate: 20
+      burst: 1
+  packaging:
+    base_url: ` + server.URL + `/packaging
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimitConfig{Rate: 20, Burst: 1}, cfg.Servers["ingest"].RateLimit)
+	_, err = ParseWorkerConfig([]byte(`
+servers:
+  ingest:
+    base_url: http://ingest
+    rate_limit:
+      rate: -1
+`))
+	assert.Error(t, err)
+
+	// The servers without a limit, including the ones declared by workflows, are used first
+	factory := NewClientFactory(cfg)
+	packaging, err := factory.Client(cfg.Servers["packaging"])
+	assert.NoError(t, err)
+	declared, err := factory.Client(ServerConfig{BaseUrl: server.URL + "/declared"})
+	assert.NoError(t, err)
+	ingest, err := factory.Client(cfg.Servers["ingest"])
+	assert.NoError(t, err)
+
+	// All servers share the limit of their host
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := packaging.R().Get(server.URL + "/packaging/streams")
+		assert.NoError(t, err)
+		_, err = declared.R().Get(server.URL + "/declared/streams")
+		assert.NoError(t, err)
+	}
+	_, err = ingest.R().Get(server.URL + "/ingest/hooks")
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 6*time.Second/20)
+
+	// A request which cannot be sent before the deadline fails right away
+	slow := NewClientFactory(&WorkerConfig{Servers: map[string]ServerConfig{}})
+	client, err := slow.Client(ServerConfig{BaseUrl: server.URL, RateLimit: RateLimitConfig{Rate: 0.1}})
+	assert.NoError(t, err)
+	_, err = client.R().Get(server.URL)
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start = time.Now()
+	sent := requests.Load()
+	_, err = client.R().SetContext(ctx).Get(server.URL)
+	var retryLater *RetryLaterError
+	assert.ErrorAs(t, err, &retryLater)
+	assert.Greater(t, retryLater.Delay, time.Second)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, sent, requests.Load())
+}
+
+func TestRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/seconds":
+			if attempts.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/date":
+			if attempts.Add(1) == 1 {
+				w.Header().Set("Retry-After", time.Now().Add(2*time.Second).UTC().Format(http.TimeFormat))
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		case "/later":
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": "quota exceeded"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client, err := newServerClient(ServerConfig{BaseUrl: server.URL},
+		ClientConfig{RetryWaitTime: time.Millisecond, RetryMaxWaitTime: 5 * time.Second}, nil, nil)
+	assert.NoError(t, err)
+	for _, path := range []string{"/seconds", "/date"} {
+		attempts.Store(0)
+		start := time.Now()
+		resp, err := client.R().Get(server.URL + path)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode(), path)
+		assert.Equal(t, int32(2), attempts.Load(), path)
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond, path)
+	}
+
+	// A Retry-After beyond the remaining time of the activity is left to the workflow
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = getResource(ctx, client, server.URL+"/later")
+	assert.Less(t, time.Since(start), time.Second)
+	err = httpActivityError(context.Background(), "live_hooks", "GetResourceError", err, nil)
+	var appErr *temporal.ApplicationError
+	if assert.True(t, errors.As(err, &appErr)) {
+		assert.Equal(t, RateLimitedError, appErr.Type())
+		assert.False(t, appErr.NonRetryable())
+		assert.Equal(t, 120*time.Second, appErr.NextRetryDelay())
+		var details HTTPErrorDetails
+		assert.NoError(t, appErr.Details(&details))
+		assert.Equal(t, http.StatusTooManyRequests, details.StatusCode)
+		assert.Contains(t, details.Body, "quota exceeded")
+	}
+}
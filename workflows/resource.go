@@ -0,0 +1,126 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+
+	"github.com/tidwall/gjson"
+)
+
+const defaultIdPath = "meta.resource_id"
+
+// selfLinkPaths are the gjson paths of the link of a representation to itself, in the HAL and
+// JSON:API conventions
+var selfLinkPaths = []string{"_links.self.href", "links.self.href", "links.self"}
+
+// ResourceKind describes how a kind of resource of a server is looked up and identified.
+// IdPath is the gjson path of the resource id in the representation of the resource. Without
+// an IdPath a `Location` header of the create response, or a `Content-Location` or `Location`
+// header of the lookup response, is the resource url, and otherwise the id is read from
+// `meta.resource_id`, or the url from the self link of the representation. The resource url is the collection url joined with the
+// id, unless ResourceUrl is set. ResourceUrl is a template over the workflow and activity
+// namespaces, where the activity namespace has the `resource_id`, `collection_url` and
+// `server_url` as well, e.g. `{{ activity.server_url }}/v2/hooks/{{ activity.resource_id }}`.
+// Operation configures the tracking of asynchronous creation, see OperationParams.
+type ResourceKind struct {
+	Lookup      LookupParams    `yaml:"lookup"`
+	IdPath      string          `yaml:"id_path"`
+	ResourceUrl string          `yaml:"resource_url"`
+	Operation   OperationParams `yaml:"operation"`
+}
+
+func (k ResourceKind) validate() error {
+	return k.Lookup.validate()
+}
+
+// resourceKindFor returns the resource kind of the activity. The server declares the kinds of
+// its resources by request path, and the activity can override each of their settings.
+func resourceKindFor(activity *Activity, server ServerConfig) ResourceKind {
+	kind := server.Resources[activity.RequestParams.Path]
+	if activity.Lookup.Strategy != "" {
+		kind.Lookup = activity.Lookup
+	}
+	if kind.Lookup.Strategy == "" {
+		kind.Lookup = LookupParams{Strategy: LookupHeader}
+	}
+	if activity.IdPath != "" {
+		kind.IdPath = activity.IdPath
+	}
+	if activity.ResourceUrl != "" {
+		kind.ResourceUrl = activity.ResourceUrl
+	}
+	if activity.Operation != nil {
+		kind.Operation = *activity.Operation
+	}
+	return kind
+}
+
+// resourceUrlOf returns the url of the resource of the activity from a representation of the
+// resource, or from the location the backend returned for it. A representation without the
+// resource id fails with a non retryable ResourceIdMissingError.
+func resourceUrlOf(ctx context.Context, activity *Activity, kind ResourceKind, serverUrl string, collectionUrl string,
+	body []byte, location string, workflowMetadata WorkflowMetadata) (string, error) {
+	var resourceId, resourceUrl string
+	if kind.IdPath == "" && location != "" {
+		base, err := url.Parse(collectionUrl)
+		if err != nil {
+			return "", err
+		}
+		locationUrl, err := base.Parse(location)
+		if err != nil {
+			return "", fmt.Errorf("ResourceUrlError: invalid location %q: %w", location, err)
+		}
+		resourceUrl = locationUrl.String()
+		resourceId = path.Base(locationUrl.Path)
+	} else {
+		idPath := kind.IdPath
+		if idPath == "" {
+			idPath = defaultIdPath
+		}
+		id := gjson.GetBytes(body, idPath)
+		if id.String() == "" && kind.IdPath == "" {
+			if link := selfLink(body); link != "" {
+				return resourceUrlOf(ctx, activity, kind, serverUrl, collectionUrl, body, link, workflowMetadata)
+			}
+		}
+		if id.String() == "" {
+			return "", newResourceIdMissingError(ctx, activity.Name, idPath, body)
+		}
+		resourceId = id.String()
+		var err error
+		resourceUrl, err = url.JoinPath(collectionUrl, resourceId)
+		if err != nil {
+			return "", err
+		}
+	}
+	if kind.ResourceUrl == "" {
+		return resourceUrl, nil
+	}
+	return resolveTemplate(kind.ResourceUrl, activity, workflowMetadata, map[string]interface{}{
+		"resource_id":    resourceId,
+		"collection_url": collectionUrl,
+		"server_url":     serverUrl,
+	})
+}
+
+// selfLink returns the link of a representation to itself, if any
+func selfLink(body []byte) string {
+	for _, linkPath := range selfLinkPaths {
+		link := gjson.GetBytes(body, linkPath)
+		if link.Type == gjson.String && link.String() != "" {
+			return link.String()
+		}
+	}
+	return ""
+}
+
+// excerpt returns the beginning of a response body for error messages
+func excerpt(body []byte) string {
+	const maxExcerpt = 512
+	if len(body) > maxExcerpt {
+		return string(body[:maxExcerpt]) + "..."
+	}
+	return string(body)
+}
@@ -0,0 +1,91 @@
+package workflows
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestCreateResourceUrl(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hooks":
+			w.Write([]byte(`{"id": "h1"}`))
+		case "/streams":
+			w.Write([]byte(`{"data": {"uuid": "0b6c"}}`))
+		case "/jobs":
+			w.Header().Set("Location", "/v2/jobs/j7")
+			w.Write([]byte(`{}`))
+		default:
+			w.Write([]byte(`{"meta": {"resource_id": "r1"}}`))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		path     string
+		kind     ResourceKind
+		expected string
+	}{
+		{"live_hooks", ResourceKind{}, server.URL + "/live_hooks/r1"},
+		{"hooks", ResourceKind{IdPath: "id"}, server.URL + "/hooks/h1"},
+		{"streams", ResourceKind{IdPath: "data.uuid"}, server.URL + "/streams/0b6c"},
+		{"jobs", ResourceKind{}, server.URL + "/v2/jobs/j7"},
+		{"hooks", ResourceKind{IdPath: "id", ResourceUrl: "{{ activity.server_url }}/v2/hooks/{{ activity.resource_id }}"},
+			server.URL + "/v2/hooks/h1"},
+		{"jobs", ResourceKind{ResourceUrl: "{{ activity.collection_url }}/{{ activity.resource_id }}?tenant={{ workflow.labels.team }}"},
+			server.URL + "/jobs/j7?tenant=media"},
+	}
+	for _, tt := range tests {
+		activity := Activity{}
+		activity.Name = tt.path
+		resourceUrl, err := createResource(context.Background(), testClient(t), &activity, tt.kind, server.URL,
+			server.URL+"/"+tt.path, WorkflowMetadata{ID: "wf", Labels: map[string]string{"team": "media"}}, []byte(`{}`))
+		assert.NoError(t, err, tt.path)
+		assert.Equal(t, tt.expected, resourceUrl, tt.path)
+	}
+}
+
+func TestCreateResourceIdMissing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"meta": {"status": "pending"}}`))
+	}))
+	defer server.Close()
+
+	for _, kind := range []ResourceKind{{}, {IdPath: "data.uuid"}} {
+		activity := Activity{}
+		activity.Name = "live_hooks"
+		_, err := createResource(context.Background(), testClient(t), &activity, kind, server.URL,
+			server.URL+"/live_hooks", WorkflowMetadata{ID: "wf"}, []byte(`{}`))
+		var appErr *temporal.ApplicationError
+		assert.ErrorAs(t, err, &appErr)
+		assert.Equal(t, ResourceIdMissingError, appErr.Type())
+		assert.True(t, appErr.NonRetryable())
+		var details ResourceIdMissingDetails
+		assert.NoError(t, appErr.Details(&details))
+		assert.Equal(t, `{"meta": {"status": "pending"}}`, details.Body)
+		if kind.IdPath != "" {
+			assert.Equal(t, kind.IdPath, details.IdPath)
+		}
+	}
+}
+
+func TestResourceKindFor(t *testing.T) {
+	server := ServerConfig{Resources: map[string]ResourceKind{
+		"hooks": {IdPath: "id", ResourceUrl: "{{ activity.collection_url }}/{{ activity.resource_id }}"},
+	}}
+	activity := Activity{}
+	activity.RequestParams.Path = "hooks"
+	assert.Equal(t, ResourceKind{
+		Lookup:      LookupParams{Strategy: LookupHeader},
+		IdPath:      "id",
+		ResourceUrl: "{{ activity.collection_url }}/{{ activity.resource_id }}",
+	}, resourceKindFor(&activity, server))
+
+	activity.IdPath = "data.uuid"
+	assert.Equal(t, "data.uuid", resourceKindFor(&activity, server).IdPath)
+}
@@ -0,0 +1,270 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	starlarkmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Defaults of the limits of scripts
+const (
+	defaultScriptMaxSteps = 1000000
+	defaultScriptTimeout  = time.Second
+)
+
+// scriptEntryPoint is the function a script defines
+const scriptEntryPoint = "main"
+
+// scriptFileOptions are the Starlark dialect of scripts
+var scriptFileOptions = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true}
+
+// scriptModules are the modules predeclared for scripts. They have no I/O and are
+// deterministic, unlike time.
+var scriptModules = starlark.StringDict{
+	"json": starlarkjson.Module,
+	"math": starlarkmath.Module,
+}
+
+// ScriptParams is the Starlark program of a script activity, which computes its result from
+// the results of the activities it depends on, e.g.
+//
+//	def main(inputs, results):
+//	    height = results["live_hooks"]["result"]["video_params"]["video_height"]
+//	    return {"variants": [v for v in inputs["ladder"] if v["height"] <= height]}
+//
+// main is called with the resolved request body of the activity and the results of its
+// dependencies by name, as `{"result": ..., "request": ...}`. A dict it returns is the result
+// of the activity, and any other value the `value` of the result. Values are JSON values:
+// integral numbers are ints, and the result must be made of dicts with string keys, lists,
+// strings, numbers, bools and None.
+//
+// Scripts are deterministic: they cannot load modules nor do I/O, and have the json and math
+// modules only. They are stopped after MaxSteps execution steps (1000000 by default) or
+// Timeout (1s by default).
+type ScriptParams struct {
+	Source   string        `yaml:"source"`
+	MaxSteps uint64        `yaml:"max_steps"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func (s ScriptParams) withDefaults() ScriptParams {
+	if s.MaxSteps == 0 {
+		s.MaxSteps = defaultScriptMaxSteps
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = defaultScriptTimeout
+	}
+	return s
+}
+
+// compile checks the syntax of the script and that it only refers to predeclared names
+func (s ScriptParams) compile(activityName string) (*starlark.Program, error) {
+	_, program, err := starlark.SourceProgramOptions(scriptFileOptions, activityName+".star", s.Source,
+		scriptModules.Has)
+	return program, err
+}
+
+// runScript runs the script of an activity with its inputs and the results of its dependencies
+func runScript(ctx context.Context, activity *Activity, inputs map[string]interface{},
+	results map[string]ActivityResult) (map[string]interface{}, error) {
+	params := activity.Script.withDefaults()
+	program, err := params.compile(activity.Name)
+	if err != nil {
+		return nil, newInvalidScriptError(activity.Name, err)
+	}
+
+	thread := &starlark.Thread{
+		Name: activity.Name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("%s: %s", activity.Name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(params.MaxSteps)
+	ctx, cancel := context.WithTimeout(ctx, params.Timeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(fmt.Sprintf("script stopped: %v", ctx.Err()))
+		case <-done:
+		}
+	}()
+
+	globals, err := program.Init(thread, scriptModules)
+	if err != nil {
+		return nil, newScriptError(activity.Name, err)
+	}
+	entryPoint, ok := globals[scriptEntryPoint].(starlark.Callable)
+	if !ok {
+		return nil, newInvalidScriptError(activity.Name, fmt.Errorf("the script does not define %s(inputs, results)",
+			scriptEntryPoint))
+	}
+	args := starlark.Tuple{toStarlark(inputs), toStarlark(dependencyObjects(results))}
+	value, err := starlark.Call(thread, entryPoint, args, nil)
+	if err != nil {
+		return nil, newScriptError(activity.Name, err)
+	}
+	output, err := fromStarlark(value)
+	if err != nil {
+		return nil, newScriptError(activity.Name, fmt.Errorf("%s returned %s: %w", scriptEntryPoint, value.Type(), err))
+	}
+	return resultObject(output), nil
+}
+
+// toStarlark converts a JSON value to Starlark. Dict keys are sorted so that scripts see the
+// same order on every run.
+func toStarlark(value interface{}) starlark.Value {
+	switch v := value.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case string:
+		return starlark.String(v)
+	case int:
+		return starlark.MakeInt(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return starlark.MakeInt64(i)
+		}
+		f, _ := v.Float64()
+		return starlark.Float(f)
+	case []interface{}:
+		list := make([]starlark.Value, 0, len(v))
+		for _, item := range v {
+			list = append(list, toStarlark(item))
+		}
+		return starlark.NewList(list)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		dict := starlark.NewDict(len(v))
+		for _, key := range keys {
+			dict.SetKey(starlark.String(key), toStarlark(v[key]))
+		}
+		return dict
+	default:
+		// Other values, e.g. of typed structs, are converted through their JSON form
+		data, err := json.Marshal(v)
+		if err != nil {
+			return starlark.None
+		}
+		var decoded interface{}
+		if json.Unmarshal(data, &decoded) != nil {
+			return starlark.None
+		}
+		return toStarlark(decoded)
+	}
+}
+
+// fromStarlark converts a Starlark value to JSON
+func fromStarlark(value starlark.Value) (interface{}, error) {
+	switch v := value.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("int %s is too large", v)
+		}
+		return i, nil
+	case starlark.Float:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("float %s is not a JSON number", v)
+		}
+		return f, nil
+	case *starlark.List:
+		return fromStarlarkIterable(v)
+	case starlark.Tuple:
+		return fromStarlarkIterable(v)
+	case *starlark.Dict:
+		dict := map[string]interface{}{}
+		for _, item := range v.Items() {
+			key, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", item[0])
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = value
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("%s is not a JSON value", value.Type())
+	}
+}
+
+func fromStarlarkIterable(iterable starlark.Iterable) ([]interface{}, error) {
+	list := []interface{}{}
+	iter := iterable.Iterate()
+	defer iter.Done()
+	var item starlark.Value
+	for iter.Next(&item) {
+		value, err := fromStarlark(item)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// scriptBacktrace returns the Starlark backtrace of a script error, if any
+func scriptBacktrace(err error) string {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return evalErr.Backtrace()
+	}
+	return ""
+}
+
+// ScriptActivity runs the script of a script activity, see ScriptParams. The results of the
+// activities it depends on, through value expressions or DependsOn, are passed to the script.
+func (a *Activities) ScriptActivity(ctx context.Context, activity *Activity,
+	activityResults map[string]ActivityResult, workflowMetadata WorkflowMetadata) (ActivityResult, error) {
+
+	dependencies := dependencyResults(activity, activityResults)
+	_, err := resolveRequestBody(activity, activityResults, workflowMetadata)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+	result, err := runScript(ctx, activity, activity.RequestParams.Body, dependencies)
+	if err != nil {
+		return ActivityResult{}, err
+	}
+
+	return ActivityResult{
+		Result:         ProjectOutputs(result, activity.Outputs),
+		Request:        activity.RequestParams.Body,
+		IdempotencyKey: activity.key,
+	}, nil
+}
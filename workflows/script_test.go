@@ -0,0 +1,128 @@
+package workflows
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+const ladderScript = `
+def main(inputs, results):
+    video = results["live_hooks"]["result"]["video_params"]
+    fps = video["frame_rate_numerator"] / video["frame_rate_denominator"]
+    variants = []
+    for rung in inputs["ladder"]:
+        if rung["height"] > video["video_height"]:
+            continue
+        bitrate = rung["bitrate"]
+        if fps > 30:
+            bitrate = int(bitrate * 1.5)
+        variants.append({"height": rung["height"], "bitrate": bitrate})
+    return {"variants": variants, "count": len(variants)}
+`
+
+func scriptActivity(source string, body map[string]interface{}) *Activity {
+	activity := &Activity{}
+	activity.Name = "ladder"
+	activity.Type = Script
+	activity.Script = ScriptParams{Source: source}
+	activity.RequestParams = RequestParams{Body: body}
+	return activity
+}
+
+func TestScript(t *testing.T) {
+	activities := NewActivities(&WorkerConfig{})
+	workflowMetadata := WorkflowMetadata{ID: "wf-1", RunID: "run-1"}
+	// Results recorded by the workflow have JSON numbers
+	activityResults := map[string]ActivityResult{
+		"live_hooks": {Result: map[string]interface{}{"video_params": map[string]interface{}{
+			"video_height": 720.0, "frame_rate_numerator": 60000.0, "frame_rate_denominator": 1001.0}}},
+		"unrelated": {Result: map[string]interface{}{"secret": "x"}},
+	}
+
+	activity := scriptActivity(ladderScript, map[string]interface{}{
+		"ladder": []interface{}{
+			map[string]interface{}{"height": 1080, "bitrate": 6000},
+			map[string]interface{}{"height": 720, "bitrate": 3000},
+			map[string]interface{}{"height": 480, "bitrate": 1500},
+		},
+		"source_height": "{{ live_hooks.result.video_params.video_height }}",
+	})
+	result, err := activities.ScriptActivity(context.Background(), activity, activityResults, workflowMetadata)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{
+			"variants": []interface{}{
+				map[string]interface{}{"height": int64(720), "bitrate": int64(4500)},
+				map[string]interface{}{"height": int64(480), "bitrate": int64(2250)},
+			},
+			"count": int64(2),
+		}, result.Result)
+	}
+
+	// Only the dependencies are passed, and values other than dicts are wrapped
+	activity = scriptActivity(`
+def main(inputs, results):
+    return sorted(results.keys())
+`, nil)
+	activity.DependsOn = []string{"live_hooks"}
+	result, err = activities.ScriptActivity(context.Background(), activity, activityResults, workflowMetadata)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]interface{}{"value": []interface{}{"live_hooks"}}, result.Result)
+	}
+
+	assertFails := func(activity *Activity, errType string, message string) {
+		t.Helper()
+		_, err := activities.ScriptActivity(context.Background(), activity, activityResults, workflowMetadata)
+		var appErr *temporal.ApplicationError
+		if assert.True(t, errors.As(err, &appErr), "%v", err) {
+			assert.Equal(t, errType, appErr.Type())
+			assert.True(t, appErr.NonRetryable())
+			assert.ErrorContains(t, err, message)
+		}
+	}
+	assertFails(scriptActivity("def main(inputs, results):\n    return time.now()\n", nil),
+		InvalidScriptError, "undefined: time")
+	assertFails(scriptActivity("x = 1\n", nil), InvalidScriptError, "does not define main")
+	assertFails(scriptActivity(`load("os.star", "environ")`+"\ndef main(inputs, results):\n    return {}\n", nil),
+		ScriptError, "load")
+	assertFails(scriptActivity("def main(inputs, results):\n    return 1 // 0\n", nil), ScriptError, "division by zero")
+	assertFails(scriptActivity("def main(inputs, results):\n    return {1: 2}\n", nil), ScriptError, "not a string")
+
+	loop := scriptActivity("def main(inputs, results):\n    while True:\n        pass\n", nil)
+	loop.Script.MaxSteps = 1000
+	assertFails(loop, ScriptError, "too many steps")
+	loop.Script = ScriptParams{Source: loop.Script.Source, MaxSteps: 1 << 62, Timeout: 50 * time.Millisecond}
+	assertFails(loop, ScriptError, "deadline exceeded")
+}
+
+func TestParseScriptWorkflow(t *testing.T) {
+	wf, err := ParseWorkflow([]byte(`
+activities:
+  - name: ladder
+    type: script
+    depends_on: [live_hooks]
+    script:
+      source: |
+        def main(inputs, results):
+            return {"height": results["live_hooks"]["result"]["video_height"]}
+`))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"live_hooks"}, FindDependencies(&Activity{ActivityParams: wf.Activities[0]}))
+		// Scripts need no server
+		assert.NoError(t, ValidateWorkflow(wf, &WorkerConfig{}))
+	}
+	_, err = ParseWorkflow([]byte(`
+activities:
+  - name: ladder
+    type: script
+    script:
+      source: |
+        def main(inputs, results)
+            return {}
+`))
+	assert.ErrorContains(t, err, "script")
+}
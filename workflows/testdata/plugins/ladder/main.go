@@ -0,0 +1,73 @@
+// Command ladder is an example plugin of wasm activities. It derives the variants of an ABR
+// ladder from the resolution of the input stream, like the script activity of the Readme:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -o ladder.wasm ./workflows/testdata/plugins/ladder
+//
+// It reads the inputs of the activity and the results of its dependencies as JSON on stdin and
+// writes the variants as JSON to stdout. The allocate_mb, spin and flood inputs exercise the
+// memory, time and output limits of the worker in tests.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// version is set with -ldflags "-X main.version=..." to tell builds apart
+var version = "1"
+
+type rung struct {
+	Height  int `json:"height"`
+	Bitrate int `json:"bitrate"`
+}
+
+type input struct {
+	Inputs struct {
+		Ladder     []rung `json:"ladder"`
+		AllocateMB int    `json:"allocate_mb"`
+		Spin       bool   `json:"spin"`
+		Flood      bool   `json:"flood"`
+	} `json:"inputs"`
+	Results map[string]struct {
+		Result struct {
+			VideoHeight int `json:"video_height"`
+		} `json:"result"`
+	} `json:"results"`
+}
+
+var sink []byte
+
+func main() {
+	var in input
+	err := json.NewDecoder(os.Stdin).Decode(&in)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid input:", err)
+		os.Exit(1)
+	}
+	if in.Inputs.AllocateMB > 0 {
+		sink = make([]byte, in.Inputs.AllocateMB<<20)
+		for i := range sink {
+			sink[i] = 1
+		}
+	}
+	for in.Inputs.Spin {
+	}
+	line := []byte("flooding stdout, ignoring write errors\n")
+	for in.Inputs.Flood {
+		os.Stdout.Write(line)
+	}
+
+	source, ok := in.Results["live_hooks"]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "the activity must depend on live_hooks")
+		os.Exit(2)
+	}
+	variants := []rung{}
+	for _, r := range in.Inputs.Ladder {
+		if r.Height <= source.Result.VideoHeight {
+			variants = append(variants, r)
+		}
+	}
+	json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"variants": variants, "version": version})
+}
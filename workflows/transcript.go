@@ -0,0 +1,303 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the transcripts of activities
+const (
+	defaultTranscriptExchanges = 20
+	defaultTranscriptBody      = 1024
+)
+
+// redactedValue replaces the values of redacted headers and body fields
+const redactedValue = "REDACTED"
+
+// Headers and JSON body fields which are always redacted
+var (
+	defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		defaultApiKeyHeader}
+	defaultRedactedFields = []string{"password", "client_secret", "access_token", "refresh_token"}
+)
+
+// TranscriptConfig configures the transcripts of the HTTP requests of activities. A transcript
+// keeps the last MaxExchanges requests of an activity attempt (20 by default) with up to
+// MaxBody bytes of their bodies (1024 by default). Credentials are redacted: the values of the
+// RedactHeaders and RedactFields (keys of JSON bodies) are replaced, in addition to the
+// authentication headers and common secret fields. Transcripts are attached to the details of
+// failed HTTP requests, and written to Dir, if set, as
+// <dir>/<workflow id>/<run id>/<activity>-<attempt>.json.
+type TranscriptConfig struct {
+	Dir           string   `yaml:"dir"`
+	MaxExchanges  int      `yaml:"max_exchanges"`
+	MaxBody       int      `yaml:"max_body"`
+	RedactHeaders []string `yaml:"redact_headers"`
+	RedactFields  []string `yaml:"redact_fields"`
+}
+
+func (c TranscriptConfig) withDefaults() TranscriptConfig {
+	if c.MaxExchanges <= 0 {
+		c.MaxExchanges = defaultTranscriptExchanges
+	}
+	if c.MaxBody <= 0 {
+		c.MaxBody = defaultTranscriptBody
+	}
+	c.RedactHeaders = append(append([]string{}, defaultRedactedHeaders...), c.RedactHeaders...)
+	c.RedactFields = append(append([]string{}, defaultRedactedFields...), c.RedactFields...)
+	return c
+}
+
+// Exchange is a request of an activity and its response, or the error it failed with
+type Exchange struct {
+	Time            time.Time
+	Method          string
+	Url             string
+	RequestHeaders  map[string]string `json:",omitempty"`
+	RequestBody     string            `json:",omitempty"`
+	StatusCode      int               `json:",omitempty"`
+	ResponseHeaders map[string]string `json:",omitempty"`
+	ResponseBody    string            `json:",omitempty"`
+	Error           string            `json:",omitempty"`
+	Latency         time.Duration
+}
+
+// Transcript is the HTTP requests of an activity attempt. Dropped counts the earlier requests
+// which were left out to keep the transcript bounded.
+type Transcript struct {
+	WorkflowId string
+	RunId      string
+	Activity   string
+	Attempt    int32
+	Exchanges  []Exchange
+	Dropped    int `json:",omitempty"`
+}
+
+// transcriptRecorder records the exchanges of an activity attempt. Response bodies are
+// captured as they are read, so that streams are not held up.
+type transcriptRecorder struct {
+	config   TranscriptConfig
+	identity requestIdentity
+
+	mu        sync.Mutex
+	exchanges []*exchangeRecord
+	dropped   int
+}
+
+type exchangeRecord struct {
+	Exchange
+	requestBody  []byte
+	responseBody []byte
+}
+
+type transcriptKey struct{}
+
+func newTranscriptRecorder(config TranscriptConfig, identity requestIdentity) *transcriptRecorder {
+	return &transcriptRecorder{config: config.withDefaults(), identity: identity}
+}
+
+// withTranscript returns a context whose requests are recorded by recorder
+func withTranscript(ctx context.Context, recorder *transcriptRecorder) context.Context {
+	return context.WithValue(ctx, transcriptKey{}, recorder)
+}
+
+// transcriptOf returns the transcript of the requests sent with the context, if they are
+// recorded.
+func transcriptOf(ctx context.Context) *Transcript {
+	recorder, ok := ctx.Value(transcriptKey{}).(*transcriptRecorder)
+	if !ok {
+		return nil
+	}
+	transcript := recorder.transcript()
+	return &transcript
+}
+
+func (r *transcriptRecorder) add(record *exchangeRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exchanges = append(r.exchanges, record)
+	if len(r.exchanges) > r.config.MaxExchanges {
+		r.exchanges = r.exchanges[1:]
+		r.dropped++
+	}
+}
+
+func (r *transcriptRecorder) transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	transcript := Transcript{
+		WorkflowId: r.identity.WorkflowId,
+		RunId:      r.identity.RunId,
+		Activity:   r.identity.ActivityName,
+		Attempt:    r.identity.Attempt,
+		Exchanges:  []Exchange{},
+		Dropped:    r.dropped,
+	}
+	for _, record := range r.exchanges {
+		exchange := record.Exchange
+		exchange.RequestBody = r.redactBody(record.requestBody)
+		exchange.ResponseBody = r.redactBody(record.responseBody)
+		transcript.Exchanges = append(transcript.Exchanges, exchange)
+	}
+	return transcript
+}
+
+// store writes the transcript to the transcript directory, if any
+func (r *transcriptRecorder) store() error {
+	if r.config.Dir == "" {
+		return nil
+	}
+	transcript := r.transcript()
+	dir := filepath.Join(r.config.Dir, pathComponent(transcript.WorkflowId), pathComponent(transcript.RunId))
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("TranscriptError: %w", err)
+	}
+	data, err := json.MarshalIndent(transcript, "", "  ")
+	if err != nil {
+		return fmt.Errorf("TranscriptError: %w", err)
+	}
+	name := fmt.Sprintf("%s-%d.json", pathComponent(transcript.Activity), transcript.Attempt)
+	err = os.WriteFile(filepath.Join(dir, name), data, 0o644)
+	if err != nil {
+		return fmt.Errorf("TranscriptError: %w", err)
+	}
+	return nil
+}
+
+// pathComponent makes a workflow or activity identifier usable as a file name
+func pathComponent(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(s)
+}
+
+func (r *transcriptRecorder) redactHeaders(header http.Header) map[string]string {
+	headers := map[string]string{}
+	for name, values := range header {
+		headers[name] = strings.Join(values, ", ")
+		for _, redacted := range r.config.RedactHeaders {
+			if strings.EqualFold(name, redacted) {
+				headers[name] = redactedValue
+			}
+		}
+	}
+	return headers
+}
+
+// redactBody returns the excerpt of a body with the values of the redacted fields replaced.
+// Bodies which are not valid JSON, like JSON bodies cut at MaxBody, are redacted textually.
+func (r *transcriptRecorder) redactBody(body []byte) string {
+	var value interface{}
+	if len(body) == 0 {
+		return ""
+	}
+	if json.Unmarshal(body, &value) != nil {
+		return r.redactText(string(body))
+	}
+	redacted, err := json.Marshal(r.redactValue(value))
+	if err != nil {
+		return r.redactText(string(body))
+	}
+	return string(redacted)
+}
+
+// redactText replaces the values of `"<field>": <value>` in text, up to the end of the value
+// or of the text
+func (r *transcriptRecorder) redactText(text string) string {
+	for _, field := range r.config.RedactFields {
+		pattern := regexp.MustCompile(`(?i)("` + regexp.QuoteMeta(field) + `"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]]*)`)
+		text = pattern.ReplaceAllString(text, `${1}"`+redactedValue+`"`)
+	}
+	return text
+}
+
+func (r *transcriptRecorder) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if containsFold(r.config.RedactFields, key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = r.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.redactValue(item)
+		}
+	}
+	return value
+}
+
+// transcriptTransport records the requests sent with a context recorded by a
+// transcriptRecorder, one exchange per attempt.
+type transcriptTransport struct {
+	base http.RoundTripper
+}
+
+func (t *transcriptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder, ok := req.Context().Value(transcriptKey{}).(*transcriptRecorder)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	record := &exchangeRecord{Exchange: Exchange{
+		Time:           time.Now(),
+		Method:         req.Method,
+		Url:            req.URL.String(),
+		RequestHeaders: recorder.redactHeaders(req.Header),
+	}}
+	if req.GetBody != nil && req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err == nil && body != nil {
+			record.requestBody, _ = io.ReadAll(io.LimitReader(body, int64(recorder.config.MaxBody)))
+			body.Close()
+		}
+	}
+	recorder.add(record)
+
+	resp, err := t.base.RoundTrip(req)
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	record.Latency = time.Since(record.Time)
+	if err != nil {
+		record.Error = err.Error()
+		return resp, err
+	}
+	record.StatusCode = resp.StatusCode
+	record.ResponseHeaders = recorder.redactHeaders(resp.Header)
+	resp.Body = &capturedBody{ReadCloser: resp.Body, recorder: recorder, record: record}
+	return resp, nil
+}
+
+// capturedBody captures the beginning of a response body as it is read
+type capturedBody struct {
+	io.ReadCloser
+	recorder *transcriptRecorder
+	record   *exchangeRecord
+}
+
+func (b *capturedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.recorder.mu.Lock()
+		if room := b.recorder.config.MaxBody - len(b.record.responseBody); room > 0 {
+			if n < room {
+				room = n
+			}
+			b.record.responseBody = append(b.record.responseBody, p[:room]...)
+		}
+		b.recorder.mu.Unlock()
+	}
+	return n, err
+}
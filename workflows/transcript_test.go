@@ -0,0 +1,145 @@
+package workflows
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func TestTranscript(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/things":
+			http.Error(w, "Not found", http.StatusNotFound)
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"meta": {"resource_id": "1"}, "access_token": "t0ken"}`))
+		default:
+			http.Error(w, `{"error": "converter down"}`, http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	activities := NewActivities(&WorkerConfig{
+		Servers: map[string]ServerConfig{DefaultServerName: {BaseUrl: server.URL,
+			Headers: map[string]string{"X-API-Key": "key", "x-tenant-secret": "s3cret", "x-tenant": "media"}}},
+		Client:      ClientConfig{RetryCount: -1},
+		Transcripts: TranscriptConfig{Dir: dir, MaxExchanges: 2, RedactHeaders: []string{"x-tenant-secret"}},
+	})
+	activity := Activity{}
+	activity.Name = "things"
+	activity.RequestParams = RequestParams{Path: "things", Method: "POST",
+		Body: map[string]interface{}{"name": "thing", "credentials": map[string]interface{}{"password": "hunter2"}}}
+	_, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil,
+		WorkflowMetadata{ID: "wf/1", RunID: "run-1"})
+
+	var appErr *temporal.ApplicationError
+	if !assert.ErrorAs(t, err, &appErr) {
+		return
+	}
+	assert.Equal(t, ServerError, appErr.Type())
+	var details HTTPErrorDetails
+	assert.NoError(t, appErr.Details(&details))
+	transcript := details.Transcript
+	if !assert.NotNil(t, transcript) {
+		return
+	}
+	assert.Equal(t, "wf/1", transcript.WorkflowId)
+	assert.Equal(t, "things", transcript.Activity)
+	// The lookup was dropped, the create and the get are kept
+	assert.Equal(t, 1, transcript.Dropped)
+	if !assert.Len(t, transcript.Exchanges, 2) {
+		return
+	}
+	create, get := transcript.Exchanges[0], transcript.Exchanges[1]
+	assert.Equal(t, http.MethodPost, create.Method)
+	assert.Equal(t, http.StatusCreated, create.StatusCode)
+	assert.Equal(t, redactedValue, create.RequestHeaders["X-Api-Key"])
+	assert.Equal(t, redactedValue, create.RequestHeaders["X-Tenant-Secret"])
+	assert.Equal(t, "media", create.RequestHeaders["X-Tenant"])
+	assert.Equal(t, "wf/1", create.RequestHeaders["X-Workflow-Id"])
+	assert.JSONEq(t, `{"name": "thing", "credentials": {"password": "REDACTED"}}`, create.RequestBody)
+	assert.JSONEq(t, `{"meta": {"resource_id": "1"}, "access_token": "REDACTED"}`, create.ResponseBody)
+	assert.Equal(t, server.URL+"/things/1", get.Url)
+	assert.Equal(t, http.StatusInternalServerError, get.StatusCode)
+	assert.Contains(t, get.ResponseBody, "converter down")
+	assert.Greater(t, get.Latency.Nanoseconds(), int64(0))
+
+	data, err := os.ReadFile(filepath.Join(dir, "wf_1", "run-1", "things-0.json"))
+	assert.NoError(t, err)
+	var stored Transcript
+	assert.NoError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, transcript.Dropped, stored.Dropped)
+	if assert.Len(t, stored.Exchanges, 2) {
+		assert.Equal(t, get.ResponseBody, stored.Exchanges[1].ResponseBody)
+		assert.Equal(t, redactedValue, stored.Exchanges[0].RequestHeaders["X-Api-Key"])
+	}
+}
+
+func TestTranscriptRedactsTruncatedBodies(t *testing.T) {
+	recorder := newTranscriptRecorder(TranscriptConfig{RedactFields: []string{"stream_key"}}, requestIdentity{})
+	assert.Equal(t, `{"name": "a", "Password": "REDACTED`+`"`, recorder.redactBody([]byte(`{"name": "a", "Password": "hun`)))
+	assert.Equal(t, `{"stream_key":"REDACTED", "n": 1, "access_token": "REDACTED"},`,
+		recorder.redactBody([]byte(`{"stream_key":"k\"ey", "n": 1, "access_token": "abc"}`+`,`)))
+	assert.Equal(t, `{"client_secret": "REDACTED"`, recorder.redactBody([]byte(`{"client_secret": 12345`)))
+}
+
+func TestTranscriptOfOtherFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"meta": {}}`))
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	run := func(serverUrl string) *temporal.ApplicationError {
+		t.Helper()
+		activities := NewActivities(&WorkerConfig{
+			Servers: map[string]ServerConfig{DefaultServerName: {BaseUrl: serverUrl}},
+			Client:  ClientConfig{RetryCount: -1},
+		})
+		activity := Activity{}
+		activity.Name = "things"
+		activity.RequestParams = RequestParams{Path: "things", Method: "POST", Body: map[string]interface{}{"name": "thing"}}
+		_, err := activities.ActivityProcessAPICall(context.Background(), &activity, nil, WorkflowMetadata{ID: "wf-1"})
+		var appErr *temporal.ApplicationError
+		assert.ErrorAs(t, err, &appErr)
+		return appErr
+	}
+
+	// A request which failed without a response
+	appErr := run(closed.URL)
+	if assert.NotNil(t, appErr) {
+		assert.Equal(t, RequestError, appErr.Type())
+		assert.False(t, appErr.NonRetryable())
+		var details HTTPErrorDetails
+		assert.NoError(t, appErr.Details(&details))
+		if assert.NotNil(t, details.Transcript) && assert.Len(t, details.Transcript.Exchanges, 1) {
+			assert.Contains(t, details.Transcript.Exchanges[0].Error, "connection refused")
+		}
+	}
+
+	// An application error built while the activity ran
+	appErr = run(server.URL)
+	if assert.NotNil(t, appErr) {
+		assert.Equal(t, ResourceIdMissingError, appErr.Type())
+		var details ResourceIdMissingDetails
+		assert.NoError(t, appErr.Details(&details))
+		if assert.NotNil(t, details.Transcript) && assert.Len(t, details.Transcript.Exchanges, 2) {
+			assert.Equal(t, http.MethodPost, details.Transcript.Exchanges[1].Method)
+		}
+	}
+}
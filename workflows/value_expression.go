@@ -1,7 +1,11 @@
 package workflows
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
 	"strings"
 )
 
@@ -10,30 +14,242 @@ import (
 // then the value of the expression is A["foo""]["boo"]["zoo]
 // Another example is `ingests.1.result.foo.boo.zoo.1` which means that the value of the expression is A["foo""]["boo"]["zoo][1]
 // Another example is `ingests.1.result.foo.boo.zoo.1.bar` which means that the value of the expression is A["foo""]["boo"]["zoo][1]["bar"]
+// Indexes can also be written as `ingests.1.result.foo.boo.zoo[1].bar`, see ParsePath.
+//
+// A string field may contain any number of value expressions mixed with literal text, e.g.
+// `rtmp://{{ live_hooks.result.host }}:{{ live_hooks.result.port }}/live`. Each expression is
+// replaced by the string form of its value. A field that is exactly one expression keeps the
+// native type of its value (number, bool, object, ...).
+
+// valueExpressionPattern matches a single `{{ ... }}` placeholder. It is non-greedy so that
+// several placeholders in the same string are matched separately.
+var valueExpressionPattern = regexp.MustCompile(`{{\s*(.*?)\s*}}`)
+
+// FindValueExpressions returns the expressions of all placeholders in s, without braces.
+func FindValueExpressions(s string) []string {
+	expressions := []string{}
+	for _, m := range valueExpressionPattern.FindAllStringSubmatch(s, -1) {
+		expressions = append(expressions, m[1])
+	}
+	return expressions
+}
+
+// singleValueExpression returns the expression of s if s consists of exactly one placeholder.
+func singleValueExpression(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	loc := valueExpressionPattern.FindStringSubmatchIndex(s)
+	if loc == nil || loc[0] != 0 || loc[1] != len(s) {
+		return "", false
+	}
+	return s[loc[2]:loc[3]], true
+}
+
+// InterpolateValueExpressions replaces every placeholder of s with the value returned by resolve.
+// If s is exactly one placeholder the resolved value is returned as is, otherwise the result is
+// a string.
+func InterpolateValueExpressions(s string, resolve func(ve string) (interface{}, error)) (interface{}, error) {
+	if ve, ok := singleValueExpression(s); ok {
+		return resolve(ve)
+	}
+
+	var resolveErr error
+	out := valueExpressionPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+		if resolveErr != nil {
+			return placeholder
+		}
+		ve := valueExpressionPattern.FindStringSubmatch(placeholder)[1]
+		value, err := resolve(ve)
+		if err != nil {
+			resolveErr = err
+			return placeholder
+		}
+		return valueToString(value)
+	})
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	return out, nil
+}
+
+// valueToString renders a value for interpolation into a larger string. Strings are inserted
+// verbatim, nil as an empty string and everything else in its JSON form.
+func valueToString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// WorkflowNamespace is the namespace of value expressions referring to the running workflow
+// instead of an activity, e.g. `workflow.id` or `workflow.labels.team`. No activity can be
+// named like it.
+const WorkflowNamespace = "workflow"
+
+// ActivityNamespace is the namespace of value expressions referring to the activity being
+// executed, e.g. `activity.name` or `activity.request_id`. No activity can be named like it.
+const ActivityNamespace = "activity"
+
+// Fields of an activity which value expressions can refer to
+const (
+	ResultField  = "result"
+	RequestField = "request"
+)
 
 func GetActivityNameFromValueExpression(ve string) string {
-	ve = strings.TrimSpace(ve)
-	ve = strings.TrimPrefix(ve, "{{")
-	ve = strings.TrimSuffix(ve, "}}")
-	ve = strings.TrimSpace(ve)
-	s := strings.Split(ve, ".result.")
-	return s[0]
+	expr, err := ParseValueExpression(ve)
+	if err != nil {
+		ve = strings.TrimSpace(ve)
+		ve = strings.TrimPrefix(ve, "{{")
+		ve = strings.TrimSuffix(ve, "}}")
+		ve = strings.TrimSpace(ve)
+		s := strings.Split(ve, ".result.")
+		return s[0]
+	}
+	return expr.Activity
 }
 
-func GetPathFromValueExpression(ve string) []string {
+// ValueExpression is a parsed value expression. It refers to one of
+//
+//	<activity>.result.<path>   the result of a completed activity
+//	<activity>.request.<path>  the resolved request body the activity sent
+//	workflow.<path>            the running workflow: id, run_id, start_time, namespace and labels
+//	activity.<path>            the activity being executed: name and request_id
+//
+// Besides the plain form, an expression can mark path segments as optional with `?` and provide
+// a fallback with `| default <value>`:
+//
+//	live_hooks.result.media_stream_input_params?.audio_params.channels
+//	live_hooks.result.meta.label | default 'unlabeled'
+//	live_hooks.result.media_stream_input_params.video_params.video_width | default 1920
+//
+// If an optional segment, or any segment after it, is missing the expression evaluates to
+// nil. The default value is used when the value is missing or nil; it is a json literal or
+// a single quoted string.
+type ValueExpression struct {
+	Expression string
+	// Activity is the referenced activity, WorkflowNamespace or ActivityNamespace
+	Activity string
+	// Field is ResultField or RequestField, it is empty for the workflow and activity namespaces
+	Field      string
+	Path       Path
+	HasDefault bool
+	Default    interface{}
+}
+
+func ParseValueExpression(ve string) (*ValueExpression, error) {
 	ve = strings.TrimSpace(ve)
 	ve = strings.TrimPrefix(ve, "{{")
 	ve = strings.TrimSuffix(ve, "}}")
 	ve = strings.TrimSpace(ve)
-	s := strings.Split(ve, ".result.")
-	return strings.Split(s[1], ".")
+	expr := ValueExpression{Expression: ve}
+
+	reference := ve
+	if i := strings.Index(ve, "|"); i >= 0 {
+		reference = strings.TrimSpace(ve[:i])
+		filter := strings.TrimSpace(ve[i+1:])
+		if !strings.HasPrefix(filter, "default ") {
+			return nil, fmt.Errorf("InvalidValueExpression: unknown filter in %q", ve)
+		}
+		value, err := parseLiteral(strings.TrimSpace(strings.TrimPrefix(filter, "default ")))
+		if err != nil {
+			return nil, fmt.Errorf("InvalidValueExpression: invalid default in %q: %w", ve, err)
+		}
+		expr.HasDefault = true
+		expr.Default = value
+	}
+
+	var pathStr string
+	if strings.HasPrefix(reference, WorkflowNamespace+".") {
+		expr.Activity = WorkflowNamespace
+		pathStr = strings.TrimPrefix(reference, WorkflowNamespace+".")
+	} else if strings.HasPrefix(reference, ActivityNamespace+".") {
+		expr.Activity = ActivityNamespace
+		pathStr = strings.TrimPrefix(reference, ActivityNamespace+".")
+	} else {
+		// Activity names may contain dots, so the first field separator ends the name
+		i := -1
+		for _, field := range []string{ResultField, RequestField} {
+			j := strings.Index(reference, "."+field+".")
+			if j >= 0 && (i < 0 || j < i) {
+				i = j
+				expr.Field = field
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("InvalidValueExpression: expected <activity>.result.<path>, "+
+				"<activity>.request.<path>, workflow.<path> or activity.<path> in %q", ve)
+		}
+		expr.Activity = reference[:i]
+		pathStr = reference[i+len(expr.Field)+2:]
+	}
+	path, err := ParsePath(pathStr)
+	if err != nil {
+		return nil, fmt.Errorf("InvalidValueExpression: %w", err)
+	}
+	expr.Path = path
+	return &expr, nil
+}
+
+// Reference renders a path below the referenced activity field or namespace, e.g. the missing
+// part of a PathNotFoundError as `live_hooks.result.media_params`.
+func (e *ValueExpression) Reference(path Path) string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s.%s", e.Activity, path)
+	}
+	return fmt.Sprintf("%s.%s.%s", e.Activity, e.Field, path)
+}
+
+// parseLiteral parses a json literal or a single quoted string
+func parseLiteral(s string) (interface{}, error) {
+	if len(s) >= 2 && strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") {
+		return s[1 : len(s)-1], nil
+	}
+	var value interface{}
+	err := json.Unmarshal([]byte(s), &value)
+	return value, err
+}
+
+// Evaluate returns the value of the expression in obj, the referenced activity field or the
+// workflow namespace. A *PathNotFoundError is returned if a required part of the path is missing.
+func (e *ValueExpression) Evaluate(obj map[string]interface{}) (interface{}, error) {
+	value, err := e.Path.Get(obj)
+	var notFound *PathNotFoundError
+	if errors.As(err, &notFound) {
+		optional := e.HasDefault
+		for _, segment := range notFound.Missing {
+			optional = optional || segment.Optional
+		}
+		if !optional {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if value == nil && e.HasDefault {
+		return e.Default, nil
+	}
+	return value, nil
 }
 
 func GetValue(obj map[string]interface{}, ve string) interface{} {
-	path := GetPathFromValueExpression(ve)
-	for _, p := range path[:len(path)-1] {
-		obj = obj[p].(map[string]interface{})
+	expr, err := ParseValueExpression(ve)
+	if err != nil {
+		log.Println("GetValue:", err)
+		return nil
+	}
+	value, err := expr.Evaluate(obj)
+	if err != nil {
+		log.Println("GetValue:", err)
+		return nil
 	}
-	log.Println("GetValue:", path, path[len(path)-1], obj)
-	return obj[path[len(path)-1]]
+	log.Println("GetValue:", expr.Path, value)
+	return value
 }
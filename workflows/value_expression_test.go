@@ -0,0 +1,186 @@
+package workflows
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+var liveHooksResult = map[string]interface{}{
+	"host": "10.34.23.1",
+	"port": float64(1935),
+	"video_params": map[string]interface{}{
+		"video_width": float64(1920),
+	},
+}
+
+func resolveLiveHooks(ve string) (interface{}, error) {
+	if GetActivityNameFromValueExpression(ve) != "live_hooks" {
+		return nil, fmt.Errorf("unknown activity in %s", ve)
+	}
+	return GetValue(liveHooksResult, ve), nil
+}
+
+func TestFindValueExpressions(t *testing.T) {
+	ves := FindValueExpressions("rtmp://{{ live_hooks.result.host }}:{{live_hooks.result.port}}/live")
+	assert.Equal(t, []string{"live_hooks.result.host", "live_hooks.result.port"}, ves)
+	assert.Empty(t, FindValueExpressions("no placeholders"))
+}
+
+func TestInterpolateValueExpressions(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected interface{}
+	}{
+		{"rtmp://{{ live_hooks.result.host }}:{{ live_hooks.result.port }}/live", "rtmp://10.34.23.1:1935/live"},
+		{"{{ live_hooks.result.port }}", float64(1935)},
+		{"  {{ live_hooks.result.video_params }} ", liveHooksResult["video_params"]},
+		{"{{ live_hooks.result.port }}{{ live_hooks.result.port }}", "19351935"},
+		{"params: {{ live_hooks.result.video_params }}", `params: {"video_width":1920}`},
+		{"plain", "plain"},
+	}
+	for _, tt := range tests {
+		out, err := InterpolateValueExpressions(tt.in, resolveLiveHooks)
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.expected, out, tt.in)
+	}
+
+	_, err := InterpolateValueExpressions("x {{ other.result.foo }}", resolveLiveHooks)
+	assert.Error(t, err)
+}
+
+func TestFindDependenciesMultipleExpressions(t *testing.T) {
+	activity := Activity{}
+	activity.Name = "mstabr"
+	activity.RequestParams.Body = map[string]interface{}{
+		"url":   "rtmp://{{ live_hooks.result.host }}:{{ live_hooks.result.port }}/live",
+		"label": "{{ ingest.result.name }}",
+	}
+	assert.ElementsMatch(t, []string{"live_hooks", "ingest"}, FindDependencies(&activity))
+}
+
+func TestValueExpressionOptionalAndDefault(t *testing.T) {
+	tests := []struct {
+		ve       string
+		expected interface{}
+	}{
+		{"live_hooks.result.video_params.video_width", float64(1920)},
+		{"live_hooks.result.audio_params?.channels", nil},
+		{"live_hooks.result.video_params?.bitrate", nil},
+		{"live_hooks.result.audio_params.channels | default 2", float64(2)},
+		{"live_hooks.result.label | default 'unlabeled'", "unlabeled"},
+		{"live_hooks.result.host | default 'unused'", "10.34.23.1"},
+		{`live_hooks.result.sizes | default [1, 2]`, []interface{}{float64(1), float64(2)}},
+	}
+	for _, tt := range tests {
+		expr, err := ParseValueExpression(tt.ve)
+		assert.NoError(t, err, tt.ve)
+		assert.Equal(t, "live_hooks", expr.Activity, tt.ve)
+		value, err := expr.Evaluate(liveHooksResult)
+		assert.NoError(t, err, tt.ve)
+		assert.Equal(t, tt.expected, value, tt.ve)
+	}
+
+	expr, _ := ParseValueExpression("live_hooks.result.audio_params.channels")
+	_, err := expr.Evaluate(liveHooksResult)
+	var notFound *PathNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, "audio_params", notFound.Missing.String())
+
+	for _, ve := range []string{"live_hooks.result.a | upper", "live_hooks.result.a | default unquoted", "live_hooks.a"} {
+		_, err := ParseValueExpression(ve)
+		assert.Error(t, err, ve)
+	}
+}
+
+func TestResolveValueExpressionsStrict(t *testing.T) {
+	activityResults := map[string]ActivityResult{"live_hooks": {Result: liveHooksResult}}
+	newActivity := func(strict bool) *Activity {
+		activity := Activity{}
+		activity.Name = "mstabr"
+		activity.Strict = strict
+		activity.RequestParams.Body = map[string]interface{}{
+			"channels": "{{ live_hooks.result.audio_params.channels }}",
+			"label":    "{{ live_hooks.result.label | default 'live' }}",
+		}
+		return &activity
+	}
+
+	activity := newActivity(false)
+	assert.NoError(t, ResolveValueExpressions(activity, activityResults, WorkflowMetadata{}))
+	assert.Nil(t, activity.RequestParams.Body["channels"])
+	assert.Equal(t, "live", activity.RequestParams.Body["label"])
+
+	err := ResolveValueExpressions(newActivity(true), activityResults, WorkflowMetadata{})
+	var appErr *temporal.ApplicationError
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, UnresolvedExpressionError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+	var details UnresolvedExpressionDetails
+	assert.NoError(t, appErr.Details(&details))
+	assert.Equal(t, UnresolvedExpressionDetails{
+		Activity:    "mstabr",
+		Expression:  "live_hooks.result.audio_params.channels",
+		MissingPath: "live_hooks.result.audio_params",
+	}, details)
+
+	// Results which were not recorded cannot be resolved by retrying the activity
+	activity = newActivity(false)
+	activity.RequestParams.Body["stream"] = "{{ mstabr_input.result.id }}"
+	err = ResolveValueExpressions(activity, activityResults, WorkflowMetadata{})
+	assert.ErrorAs(t, err, &appErr)
+	assert.Equal(t, UnresolvedExpressionError, appErr.Type())
+	assert.True(t, appErr.NonRetryable())
+	assert.NoError(t, appErr.Details(&details))
+	assert.Equal(t, "mstabr_input", details.MissingPath)
+}
+
+func TestResolveValueExpressionsNamespaces(t *testing.T) {
+	activityResults := map[string]ActivityResult{
+		"live_hooks": {
+			Result:  liveHooksResult,
+			Request: map[string]interface{}{"sender_port": float64(12345)},
+		},
+	}
+	workflowMetadata := WorkflowMetadata{
+		ID:        "liv-hooks-mstabr",
+		RunID:     "run-1",
+		StartTime: time.Date(2023, 4, 1, 10, 0, 0, 0, time.UTC),
+		Namespace: "default",
+		Labels:    map[string]string{"team": "media"},
+	}
+	activity := Activity{}
+	activity.Name = "mstabr"
+	activity.RequestParams.Body = map[string]interface{}{
+		"owner":       "{{ workflow.id }}/{{ workflow.run_id }}",
+		"created":     "{{ workflow.start_time }}",
+		"namespace":   "{{ workflow.namespace }}",
+		"team":        "{{ workflow.labels.team }}",
+		"sender_port": "{{ live_hooks.request.sender_port }}",
+	}
+	assert.Equal(t, []string{"live_hooks"}, FindDependencies(&activity))
+	assert.NoError(t, ResolveValueExpressions(&activity, activityResults, workflowMetadata))
+	assert.Equal(t, map[string]interface{}{
+		"owner":       "liv-hooks-mstabr/run-1",
+		"created":     "2023-04-01T10:00:00Z",
+		"namespace":   "default",
+		"team":        "media",
+		"sender_port": float64(12345),
+	}, activity.RequestParams.Body)
+}
+
+func TestParseValueExpressionNamespaces(t *testing.T) {
+	expr, err := ParseValueExpression("ingests.1.request.url")
+	assert.NoError(t, err)
+	assert.Equal(t, "ingests.1", expr.Activity)
+	assert.Equal(t, RequestField, expr.Field)
+	assert.Equal(t, "url", expr.Path.String())
+
+	expr, err = ParseValueExpression("workflow.labels.team")
+	assert.NoError(t, err)
+	assert.Equal(t, WorkflowNamespace, expr.Activity)
+	assert.Equal(t, "workflow.labels.team", expr.Reference(expr.Path))
+}
@@ -0,0 +1,177 @@
+package workflows
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+)
+
+// Default paths of the watch endpoints, relative to the resource url
+const (
+	defaultSSEWatchPath = "events"
+)
+
+// longPollMinHold is how long a backend which honours `Prefer: wait` holds a long poll at
+// least. A 304 Not Modified sooner than that means the backend does not hold requests.
+const longPollMinHold = time.Second
+
+// watchResource watches a resource instead of polling it, and calls evaluate with every
+// representation the backend sends until evaluate reports completion or fails. Two watch modes
+// are supported:
+//
+//   - sse: a Server-Sent Events stream on <resource url>/events. The data of every event is the
+//     json representation of the resource.
+//   - long_poll: repeated GETs of the resource with `If-None-Match` set to the last ETag and
+//     `Prefer: wait=<seconds>`. The backend answers as soon as the representation changes, or
+//     with 304 Not Modified when the wait expires. A backend which answers 304 at once, without
+//     holding the request, is polled following the wait policy instead.
+//
+// An error which is not returned by evaluate means the watch failed, e.g. the stream was
+// disconnected, and the caller falls back to polling.
+func watchResource(ctx context.Context, client *resty.Client, wait WaitParams, resourceUrl string,
+	evaluate func(map[string]interface{}) (bool, error)) (map[string]interface{}, error) {
+	watchPath := wait.WatchPath
+	if watchPath == "" && wait.Mode == WaitModeSSE {
+		watchPath = defaultSSEWatchPath
+	}
+	watchUrl := resourceUrl
+	if watchPath != "" {
+		var err error
+		watchUrl, err = url.JoinPath(resourceUrl, watchPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch wait.Mode {
+	case WaitModeSSE:
+		// The request timeout of the server does not apply to the stream
+		streamClient := *client.GetClient()
+		streamClient.Timeout = 0
+		return watchResourceSSE(ctx, &streamClient, client.Header, watchUrl, evaluate)
+	case WaitModeLongPoll:
+		// The backend holds every request up to the wait, the request timeout of the server
+		// applies on top of it
+		pollClient := *client.GetClient()
+		if pollClient.Timeout > 0 {
+			pollClient.Timeout += wait.MaxInterval
+		}
+		return watchResourceLongPoll(ctx, &pollClient, client.Header, watchUrl, wait, evaluate)
+	}
+	return nil, fmt.Errorf("WatchError: unknown watch mode %q", wait.Mode)
+}
+
+func watchResourceSSE(ctx context.Context, httpClient *http.Client, header http.Header, watchUrl string,
+	evaluate func(map[string]interface{}) (bool, error)) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, watchUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("WatchError: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WatchError: %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	data := []string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		}
+		// Other fields and comments are ignored, a blank line dispatches the event
+		if line != "" || len(data) == 0 {
+			continue
+		}
+		respMap := map[string]interface{}{}
+		err := json.Unmarshal([]byte(strings.Join(data, "\n")), &respMap)
+		data = data[:0]
+		if err != nil {
+			return nil, fmt.Errorf("WatchError: %w", err)
+		}
+		complete, err := evaluate(respMap)
+		if err != nil || complete {
+			return respMap, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("WatchError: %w", err)
+	}
+	return nil, fmt.Errorf("WatchError: stream closed")
+}
+
+func watchResourceLongPoll(ctx context.Context, httpClient *http.Client, header http.Header, watchUrl string,
+	wait WaitParams, evaluate func(map[string]interface{}) (bool, error)) (map[string]interface{}, error) {
+	etag := ""
+	interval := wait.InitialInterval
+	for {
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, watchUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+		req.Header.Set("Prefer", fmt.Sprintf("wait=%d", int(wait.MaxInterval.Seconds())))
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("WatchError: %w", err)
+		}
+		respMap := map[string]interface{}{}
+		switch resp.StatusCode {
+		case http.StatusNotModified:
+			resp.Body.Close()
+			if time.Since(start) >= longPollMinHold {
+				interval = wait.InitialInterval
+				continue
+			}
+			// The backend did not hold the request, wait before asking again
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(wait.jittered(interval)):
+			}
+			interval = time.Duration(float64(interval) * wait.Multiplier)
+			if interval > wait.MaxInterval {
+				interval = wait.MaxInterval
+			}
+			continue
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&respMap)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("WatchError: %w", err)
+			}
+		default:
+			resp.Body.Close()
+			return nil, fmt.Errorf("WatchError: %d", resp.StatusCode)
+		}
+		interval = wait.InitialInterval
+		etag = resp.Header.Get("ETag")
+		complete, err := evaluate(respMap)
+		if err != nil || complete {
+			return respMap, err
+		}
+		if etag == "" {
+			// Without an ETag the backend cannot hold the request, this would be a busy loop
+			return nil, fmt.Errorf("WatchError: no ETag in long poll response")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package workflows
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.temporal.io/sdk/temporal"
+)
+
+func newWatchedActivity(mode string) *Activity {
+	activity := Activity{}
+	activity.Name = "live_hooks"
+	activity.CompletenessCondition = "{{ .result.meta.status }} == 'created'"
+	activity.Wait = WaitParams{
+		Mode: mode,
+		// Long enough that the tests only pass if the resource is watched
+		InitialInterval: time.Minute,
+		MaxDuration:     5 * time.Second,
+	}
+	return &activity
+}
+
+func TestWaitForConditionSSE(t *testing.T) {
+	server := httptest.NewServer(newMockRouter())
+	defer server.Close()
+
+	liveHook := liveHooksResp{}
+	liveHook.Meta.ResourceId = "watched-live-hook"
+	liveHook.Meta.Status = "pending"
+	storeLiveHook(liveHook)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		liveHook.Meta.Status = "created"
+		storeLiveHook(liveHook)
+	}()
+
+	start := time.Now()
+	resource, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), newWatchedActivity(WaitModeSSE),
+		server.URL+"/live_hooks/watched-live-hook")
+	assert.NoError(t, err)
+	assert.Equal(t, "created", resource["meta"].(map[string]interface{})["status"])
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestWaitForConditionSSEFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live_hooks/1/events" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"meta": {"status": "created"}}`))
+	}))
+	defer server.Close()
+
+	resource, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), newWatchedActivity(WaitModeSSE),
+		server.URL+"/live_hooks/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "created", resource["meta"].(map[string]interface{})["status"])
+}
+
+func TestWaitForConditionLongPoll(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "wait=300", r.Header.Get("Prefer"))
+		switch requests.Add(1) {
+		case 1:
+			w.Header().Set("ETag", `"1"`)
+			w.Write([]byte(`{"meta": {"status": "pending"}}`))
+		case 2:
+			assert.Equal(t, `"1"`, r.Header.Get("If-None-Match"))
+			// The backend holds the request until the wait expires
+			time.Sleep(longPollMinHold)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"2"`)
+			w.Write([]byte(`{"meta": {"status": "created"}}`))
+		}
+	}))
+	defer server.Close()
+
+	resource, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), newWatchedActivity(WaitModeLongPoll),
+		server.URL+"/live_hooks/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "created", resource["meta"].(map[string]interface{})["status"])
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestWaitForConditionLongPollTimeout(t *testing.T) {
+	// The backend holds the request longer than the request timeout of the server
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "wait=1", r.Header.Get("Prefer"))
+		if requests.Add(1) == 1 {
+			w.Header().Set("ETag", `"1"`)
+			w.Write([]byte(`{"meta": {"status": "pending"}}`))
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+		w.Header().Set("ETag", `"2"`)
+		w.Write([]byte(`{"meta": {"status": "created"}}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClientFactory(nil).Client(ServerConfig{Timeout: 200 * time.Millisecond})
+	assert.NoError(t, err)
+	activity := newWatchedActivity(WaitModeLongPoll)
+	activity.Wait.MaxInterval = time.Second
+	resource, err := WaitForCompletenessConditionCriteria(context.Background(), client, activity, server.URL+"/live_hooks/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "created", resource["meta"].(map[string]interface{})["status"])
+	// The watch does not fall back to polling
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestWaitForConditionLongPollNotHeld(t *testing.T) {
+	// The backend honours If-None-Match but not Prefer: wait
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("If-None-Match") == `"1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"1"`)
+		w.Write([]byte(`{"meta": {"status": "pending"}}`))
+	}))
+	defer server.Close()
+
+	activity := newWatchedActivity(WaitModeLongPoll)
+	activity.Wait.InitialInterval = 20 * time.Millisecond
+	activity.Wait.MaxDuration = 500 * time.Millisecond
+	_, err := WaitForCompletenessConditionCriteria(context.Background(), testClient(t), activity, server.URL+"/live_hooks/1")
+	var appErr *temporal.ApplicationError
+	if assert.ErrorAs(t, err, &appErr) {
+		assert.Equal(t, ConditionTimeoutError, appErr.Type())
+	}
+	// 304s are followed by growing intervals: 20ms, 40ms, 80ms, 160ms, ...
+	assert.Less(t, requests.Load(), int32(10))
+}
@@ -1,8 +1,10 @@
 package workflows
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"time"
 
 	"github.com/heimdalr/dag"
@@ -19,6 +21,46 @@ const (
 type Activity struct {
 	ActivityParams
 	ActivityStatus ActivityStatus
+	// ServerConfig is the server of the activity if the workflow declares it, otherwise the
+	// server is looked up in the worker configuration.
+	ServerConfig *ServerConfig
+	// key is the idempotency key of the activity, computed when it is executed
+	key string
+}
+
+// WorkflowMetadata describes the running workflow to value expressions in the `workflow`
+// namespace. It is taken from workflow.GetInfo, which keeps the expressions deterministic.
+type WorkflowMetadata struct {
+	ID        string
+	RunID     string
+	StartTime time.Time
+	Namespace string
+	Labels    map[string]string
+}
+
+func NewWorkflowMetadata(ctx workflow.Context, model *Workflow) WorkflowMetadata {
+	info := workflow.GetInfo(ctx)
+	return WorkflowMetadata{
+		ID:        info.WorkflowExecution.ID,
+		RunID:     info.WorkflowExecution.RunID,
+		StartTime: info.WorkflowStartTime,
+		Namespace: info.Namespace,
+		Labels:    model.Labels,
+	}
+}
+
+func (m WorkflowMetadata) namespaceObject() map[string]interface{} {
+	labels := map[string]interface{}{}
+	for k, v := range m.Labels {
+		labels[k] = v
+	}
+	return map[string]interface{}{
+		"id":         m.ID,
+		"run_id":     m.RunID,
+		"start_time": m.StartTime.UTC().Format(time.RFC3339Nano),
+		"namespace":  m.Namespace,
+		"labels":     labels,
+	}
 }
 
 type WorkflowCtxt struct {
@@ -33,15 +75,90 @@ func CreateWorkflowCtxt(workflow *Workflow) *WorkflowCtxt {
 		a := Activity{}
 		a.ActivityParams = activity
 		a.ActivityStatus = Pending
+		if server, ok := workflow.Servers[activity.serverName()]; ok {
+			a.ServerConfig = &server
+		}
 		allActivities = append(allActivities, a)
 	}
 	wfCtxt.ActivityDag = CreateActivityDAG(allActivities)
 	return &wfCtxt
 }
 
+// createdResources returns all resources created so far with their servers, sorted by url to
+// keep the workflow deterministic.
+func createdResources(model *Workflow, activityResults map[string]ActivityResult) []CreatedResource {
+	resources := []CreatedResource{}
+	for _, activityResult := range activityResults {
+		// Activities which are not API calls create no resource
+		if activityResult.ResourceUrl != "" {
+			resources = append(resources, createdResource(model, activityResult.ResourceUrl, activityResult.Server))
+		}
+	}
+	sort.Slice(resources, func(i, j int) bool { return resources[i].Url < resources[j].Url })
+	return resources
+}
+
+func createdResource(model *Workflow, resourceUrl string, serverName string) CreatedResource {
+	resource := CreatedResource{Url: resourceUrl, Server: serverName}
+	if server, ok := model.Servers[serverName]; ok {
+		resource.ServerConfig = &server
+	}
+	return resource
+}
+
+// failedResourceUrl returns the url of the resource an activity created before it failed with
+// a ResourceFailedError, so that the resource is cleaned up too.
+func failedResourceUrl(activityErr error) string {
+	var appErr *temporal.ApplicationError
+	if !errors.As(activityErr, &appErr) || appErr.Type() != ResourceFailedError {
+		return ""
+	}
+	var details ResourceFailedDetails
+	if appErr.Details(&details) != nil {
+		return ""
+	}
+	return details.ResourceUrl
+}
+
+// defaultActivityTimeout bounds every activity, and activityHeartbeatTimeout the activities
+// which wait longer, see activityOptions
+const (
+	defaultActivityTimeout   = time.Minute
+	activityHeartbeatTimeout = 30 * time.Second
+)
+
+// activityOptions returns the options of an activity of the workflow. An activity waits for its
+// operation and then for its completeness condition up to the MaxDuration of its wait policy
+// each, so that its timeout is extended by both waits and it fails with a ConditionTimeoutError
+// rather than Temporal's timeout. Such an activity heartbeats while it waits, so that a lost
+// worker is noticed without waiting for the timeout.
+func activityOptions(options workflow.ActivityOptions, activity *Activity) workflow.ActivityOptions {
+	if activity.Wait.MaxDuration > 0 {
+		options.StartToCloseTimeout += 2 * activity.Wait.MaxDuration
+		options.HeartbeatTimeout = activityHeartbeatTimeout
+	}
+	return options
+}
+
+// activityFunc returns the activity executing an activity of the workflow, by its type
+func activityFunc(activities *Activities, activity *Activity) interface{} {
+	switch activity.Type {
+	case GrpcCall:
+		return activities.GrpcCallActivity
+	case GraphQL:
+		return activities.GraphQLActivity
+	case Script:
+		return activities.ScriptActivity
+	case Wasm:
+		return activities.WasmActivity
+	default:
+		return activities.ActivityProcessAPICall
+	}
+}
+
 func ApiWorkflow(ctx workflow.Context, model *Workflow) (string, error) {
 	var output string
-	activityResponses := make(map[string]string, model.NumActivities)
+	activityResults := make(map[string]ActivityResult, model.NumActivities)
 
 	// RetryPolicy specifies how to automatically handle retries if an Activity fails.
 	retrypolicy := &temporal.RetryPolicy{
@@ -49,12 +166,12 @@ func ApiWorkflow(ctx workflow.Context, model *Workflow) (string, error) {
 		BackoffCoefficient:     2.0,
 		MaximumInterval:        100 * time.Second,
 		MaximumAttempts:        2, // unlimited retries
-		NonRetryableErrorTypes: []string{"RequestMarshalError"},
+		NonRetryableErrorTypes: []string{RequestMarshalError},
 	}
 
 	options := workflow.ActivityOptions{
 		// Timeout options specify when to automatically timeout Activity functions.
-		StartToCloseTimeout: 1 * time.Minute,
+		StartToCloseTimeout: defaultActivityTimeout,
 		// Optionally provide a customized RetryPolicy.
 		// Temporal retries failed Activities by default.
 		RetryPolicy: retrypolicy,
@@ -65,29 +182,38 @@ func ApiWorkflow(ctx workflow.Context, model *Workflow) (string, error) {
 	// Apply the options.
 	ctx = workflow.WithActivityOptions(ctx, options)
 
-	workflowId := workflow.GetInfo(ctx).WorkflowExecution.ID
+	workflowMetadata := NewWorkflowMetadata(ctx, model)
+
+	// The activities are methods of the Activities registered with the worker
+	var activities *Activities
 
 	for {
-		activities := GetActivitiesForProcessing(wfCtxt.ActivityDag)
-		if len(activities) == 0 {
+		activityNames := GetActivitiesForProcessing(wfCtxt.ActivityDag)
+		if len(activityNames) == 0 {
 			break
 		}
-		for _, activityName := range activities {
+		for _, activityName := range activityNames {
 			log.Println("Processing activity: ", activityName)
 			activity := GetActivityFromID(wfCtxt.ActivityDag, activityName)
 			log.Println("Activity: ", activity)
 			// Execute activity
-			activityErr := workflow.ExecuteActivity(ctx, ActivityProcessAPICall, activity, activityResponses, workflowId).Get(ctx, &output)
+			var activityResult ActivityResult
+			activityCtx := workflow.WithActivityOptions(ctx, activityOptions(options, activity))
+			activityErr := workflow.ExecuteActivity(activityCtx, activityFunc(activities, activity), activity, activityResults, workflowMetadata).Get(ctx, &activityResult)
 			if activityErr != nil {
 				// Cleanup
-				activityErr := workflow.ExecuteActivity(ctx, CleanupActivity, activityResponses).Get(ctx, &output)
-				if activityErr != nil {
+				cleanupResources := createdResources(model, activityResults)
+				if failedUrl := failedResourceUrl(activityErr); failedUrl != "" {
+					cleanupResources = append(cleanupResources, createdResource(model, failedUrl, activity.serverName()))
+				}
+				cleanupErr := workflow.ExecuteActivity(ctx, activities.CleanupActivity, cleanupResources).Get(ctx, &output)
+				if cleanupErr != nil {
 					return "",
-						fmt.Errorf("Failed to cleanup resources: %w", activityErr)
+						fmt.Errorf("Failed to cleanup resources: %w", cleanupErr)
 				}
 				return "", activityErr
 			}
-			activityResponses[activityName] = output
+			activityResults[activityName] = activityResult
 			activity.ActivityStatus = Completed
 		}
 	}
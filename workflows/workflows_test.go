@@ -9,51 +9,28 @@ import (
 
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/worker"
-
-	yaml "gopkg.in/yaml.v3"
 )
 
 const TaskQueName = "casApiWorkflowQueue"
 
 func createWorkflowModel(t *testing.T, wf string) *Workflow {
-	// open wf file and parse yaml file into map[string]interface{}
-	wfData := make(map[string]interface{})
 	// Read data from wf files
 	wfBytes, err := os.ReadFile(wf)
 	if err != nil {
 		t.Fatalf("Failed to read workflow file: %v", err)
 	}
-	// Unmarshal yaml data into map[string]interface{}
 	log.Println(string(wfBytes))
-	err = yaml.Unmarshal(wfBytes, &wfData)
+
+	// Create workflow model from yaml data
+	wfModel, err := ParseWorkflow(wfBytes)
 	if err != nil {
 		t.Fatalf("Failed to unmarshal workflow file: %v", err)
 	}
-
-	// Create workflow model
-	wfModel := Workflow{}
-
-	// Create workflow model from wfData
-	for _, v := range wfData["activities"].([]interface{}) {
-		activity := v.(map[string]interface{})
-		activityValue := ActivityParams{}
-		activityValue.Name = activity["name"].(string)
-		activityValue.Type = ActivityType(activity["type"].(string))
-		activityValue.CompletenessCondition = activity["completeness_condition"].(string)
-
-		activityValue.RequestParams = RequestParams{}
-		activityValue.RequestParams.Path = activity["request_params"].(map[string]interface{})["path"].(string)
-		activityValue.RequestParams.Method = activity["request_params"].(map[string]interface{})["method"].(string)
-		activityValue.RequestParams.Body = activity["request_params"].(map[string]interface{})["body"].(map[string]interface{})
-
-		wfModel.Activities = append(wfModel.Activities, activityValue)
-	}
-	wfModel.NumActivities = len(wfModel.Activities)
-	return &wfModel
+	return wfModel
 
 }
 
-func temporalWorker() {
+func temporalWorker(cfg *WorkerConfig) {
 	c, err := client.Dial(client.Options{})
 	if err != nil {
 		log.Fatalln("Unable to create Temporal client.", err)
@@ -64,8 +41,7 @@ func temporalWorker() {
 
 	// This worker hosts both Workflow and Activity functions.
 	w.RegisterWorkflow(ApiWorkflow)
-	w.RegisterActivity(ActivityProcessAPICall)
-	w.RegisterActivity(CleanupActivity)
+	w.RegisterActivity(NewActivities(cfg))
 
 	// Start listening to the Task Queue.
 	err = w.Run(worker.InterruptCh())
@@ -74,8 +50,11 @@ func temporalWorker() {
 	}
 }
 
-func startWorkflow(t *testing.T) {
+func startWorkflow(t *testing.T, cfg *WorkerConfig) {
 	wfModel := createWorkflowModel(t, "testdata/eg_workflow.yaml")
+	if err := ValidateWorkflow(wfModel, cfg); err != nil {
+		t.Fatalf("Invalid workflow: %v", err)
+	}
 
 	c, err := client.Dial(client.Options{})
 
@@ -113,12 +92,17 @@ func startWorkflow(t *testing.T) {
 
 func Test_Workflow1(t *testing.T) {
 	os.Setenv("CAS_SERVER", "http://localhost:9200")
+	// The default server of the worker is taken from CAS_SERVER
+	cfg, err := ParseWorkerConfig(nil)
+	if err != nil {
+		t.Fatalf("Invalid worker config: %v", err)
+	}
 	// Start a mock server
 	go initMockServer()
 
 	time.Sleep(2 * time.Second) // Wait for mock server to start
 
-	go temporalWorker()
+	go temporalWorker(cfg)
 
-	startWorkflow(t)
+	startWorkflow(t, cfg)
 }
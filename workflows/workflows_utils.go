@@ -1,54 +1,90 @@
 package workflows
 
 import (
-	"fmt"
-	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 type Match struct {
-	pathArr []string
-	value   string
+	path  Path
+	value string
 }
 
-func FindPathAndValuesWithPattern(pattern *regexp.Regexp, obj map[string]interface{}, path []string, output []Match) []Match {
+// FindPathAndValuesWithPattern returns the path and value of every string in obj matching the
+// pattern. Nested objects and lists, including lists of lists, are walked recursively.
+func FindPathAndValuesWithPattern(pattern *regexp.Regexp, obj map[string]interface{}, path Path, output []Match) []Match {
 	for k, v := range obj {
+		output = findPathAndValuesWithPattern(pattern, v, path.Key(k), output)
+	}
+	return output
+}
 
-		if reflect.TypeOf(v).Kind() == reflect.Map {
-			path = append(path, k)
-			output = FindPathAndValuesWithPattern(pattern, v.(map[string]interface{}), path, output)
-			path = path[:len(path)-1]
-		} else if reflect.TypeOf(v).Kind() == reflect.String {
-			if pattern.MatchString(v.(string)) {
-				//fmt.Println("appending")
-				path = append(path, k)
-				dst := make([]string, len(path))
+func findPathAndValuesWithPattern(pattern *regexp.Regexp, v interface{}, path Path, output []Match) []Match {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		output = FindPathAndValuesWithPattern(pattern, value, path, output)
+	case []interface{}:
+		for i, item := range value {
+			output = findPathAndValuesWithPattern(pattern, item, path.Index(i), output)
+		}
+	case string:
+		if pattern.MatchString(value) {
+			output = append(output, Match{path, strings.TrimSpace(value)})
+		}
+	}
+	return output
+}
 
-				copy(dst, path)
+// ProjectOutputs trims a resource representation down to the given output paths, e.g.
+// `meta.status` or `hls_abr_settings.variants[0]`, see ParsePath. The nesting of the resource is
+// kept so that value expressions read the same way with and without a projection: lists are
+// padded with nulls up to the projected items. Paths missing from the resource are skipped. If
+// no outputs are given the resource is returned as is.
+func ProjectOutputs(resource map[string]interface{}, outputs []string) map[string]interface{} {
+	if len(outputs) == 0 {
+		return resource
+	}
+	projected := map[string]interface{}{}
+	for _, output := range outputs {
+		path, err := ParsePath(output)
+		if err != nil || len(path) == 0 {
+			continue
+		}
+		if _, err := path.Get(resource); err != nil {
+			continue
+		}
+		projected = project(resource, projected, path).(map[string]interface{})
+	}
+	return projected
+}
 
-				output = append(output, Match{dst, strings.TrimSpace(v.(string))})
-				path = path[:len(path)-1]
-			}
-		} else if reflect.TypeOf(v).Kind() == reflect.Slice || reflect.TypeOf(v).Kind() == reflect.Array {
-			path = append(path, k)
-			//s := reflect.ValueOf(v)
-			for i, item := range v.([]interface{}) {
-				path[len(path)-1] = fmt.Sprintf("%s[%d]", k, i)
-				if reflect.TypeOf(item).Kind() == reflect.Map {
-					output = FindPathAndValuesWithPattern(pattern, reflect.ValueOf(item).Interface().(map[string]interface{}), path, output)
-				} else if reflect.TypeOf(item).Kind() == reflect.String {
-					if pattern.MatchString(reflect.ValueOf(item).Interface().(string)) {
-						dst := make([]string, len(path))
-						copy(dst, path)
-						output = append(output, Match{dst, strings.TrimSpace(reflect.ValueOf(item).Interface().(string))})
-					}
-				}
-			}
-			path = path[:len(path)-1]
+// project copies the value at path in src, which exists, to the same path in dst and returns
+// dst, creating the objects and lists along the path
+func project(src interface{}, dst interface{}, path Path) interface{} {
+	if len(path) == 0 {
+		return src
+	}
+	segment := path[0]
+	next, _ := step(src, segment)
+	if _, ok := src.([]interface{}); ok {
+		index := segment.Index
+		if !segment.IsIndex {
+			index, _ = strconv.Atoi(segment.Key)
+		}
+		list, _ := dst.([]interface{})
+		for len(list) <= index {
+			list = append(list, nil)
 		}
+		list[index] = project(next, list[index], path[1:])
+		return list
 	}
-	return output
+	object, ok := dst.(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+	}
+	object[segment.Key] = project(next, object[segment.Key], path[1:])
+	return object
 }
 
 /*
@@ -62,6 +98,6 @@ func main() {
 		"key5": "{{.ingests.1.response.url}}",
 	}
 
-	output := FindPathAndValuesWithPattern(regexp.MustCompile("{{.*}}"), c1, []string{}, []Match{})
+	output := FindPathAndValuesWithPattern(regexp.MustCompile("{{.*}}"), c1, Path{}, []Match{})
 	fmt.Println(output)
 }*/
@@ -3,9 +3,9 @@ package workflows
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"reflect"
 	"regexp"
-	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,14 +44,146 @@ var expectedOut = map[string]string{
 func Test1(t *testing.T) {
 	c1 := map[string]interface{}{}
 	json.Unmarshal([]byte(jsonInp), &c1)
-	output := FindPathAndValuesWithPattern(regexp.MustCompile(".*"), c1, []string{}, []Match{})
+	output := FindPathAndValuesWithPattern(regexp.MustCompile(".*"), c1, Path{}, []Match{})
 	fmt.Println(output)
 	fm := map[string]string{}
 	for _, match := range output {
-		k := strings.Join(match.pathArr, ".")
+		k := match.path.String()
 		v := match.value
 		fm[k] = v
 		fmt.Println(k, v)
 	}
 	assert.Equal(t, true, reflect.DeepEqual(fm, expectedOut))
 }
+
+func TestProjectOutputs(t *testing.T) {
+	resource := map[string]interface{}{
+		"meta": map[string]interface{}{"resource_id": "abc", "status": "created"},
+		"media_stream_input_params": map[string]interface{}{
+			"video_params": map[string]interface{}{"video_width": float64(1920)},
+			"audio_params": map[string]interface{}{"channels": float64(2)},
+		},
+	}
+	projected := ProjectOutputs(resource, []string{"meta.status", "media_stream_input_params.video_params", "missing.path",
+		"meta.status.code", "media_stream_input_params.audio_params.missing.path"})
+	assert.Equal(t, map[string]interface{}{
+		"meta": map[string]interface{}{"status": "created"},
+		"media_stream_input_params": map[string]interface{}{
+			"video_params": map[string]interface{}{"video_width": float64(1920)},
+		},
+	}, projected)
+	assert.Equal(t, resource, ProjectOutputs(resource, nil))
+
+	// Items of lists keep their index
+	resource["hls_abr_settings"] = map[string]interface{}{"variants": []interface{}{
+		map[string]interface{}{"video_width": float64(1920), "bitrate": float64(6000)},
+		map[string]interface{}{"video_width": float64(1280), "bitrate": float64(3000)},
+	}}
+	projected = ProjectOutputs(resource, []string{"hls_abr_settings.variants[1].video_width", "hls_abr_settings.variants[3]"})
+	assert.Equal(t, map[string]interface{}{
+		"hls_abr_settings": map[string]interface{}{"variants": []interface{}{
+			nil,
+			map[string]interface{}{"video_width": float64(1280)},
+		}},
+	}, projected)
+	path, err := ParsePath("hls_abr_settings.variants[1].video_width")
+	assert.NoError(t, err)
+	value, err := path.Get(projected)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1280), value)
+
+	_, err = ParseWorkflow([]byte("activities:\n  - name: live_hooks\n    outputs: ['meta.tags[x]']\n"))
+	assert.ErrorContains(t, err, "outputs")
+}
+
+func TestParseWorkflow(t *testing.T) {
+	wfBytes, err := os.ReadFile("testdata/eg_workflow.yaml")
+	assert.NoError(t, err)
+	wf, err := ParseWorkflow(wfBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, wf.NumActivities)
+	assert.Equal(t, "live_hooks", wf.Activities[0].Name)
+	assert.Equal(t, []string{"meta", "media_stream_input_params.video_params"}, wf.Activities[0].Outputs)
+	assert.Equal(t, []string{"live_hooks"}, FindDependencies(&Activity{ActivityParams: wf.Activities[1]}))
+}
+
+func TestParsePath(t *testing.T) {
+	for _, s := range []string{"key1", "key2.key3", "key7[1].key3", "key6[0]", "a[0][2].b"} {
+		path, err := ParsePath(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, s, path.String())
+	}
+	path, _ := ParsePath("key7[1].key3")
+	assert.Equal(t, "/key7/1/key3", path.Pointer())
+
+	for _, s := range []string{"a..b", "a[x]", "a[1", "[0]"} {
+		_, err := ParsePath(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPathGetSet(t *testing.T) {
+	c1 := map[string]interface{}{}
+	json.Unmarshal([]byte(jsonInp), &c1)
+
+	output := FindPathAndValuesWithPattern(regexp.MustCompile("{{.*}}"), c1, Path{}, []Match{})
+	assert.Len(t, output, 4)
+	for _, match := range output {
+		v, err := match.path.Get(c1)
+		assert.NoError(t, err)
+		assert.Equal(t, match.value, v)
+		assert.NoError(t, match.path.Set(c1, match.path.String()))
+	}
+	assert.Equal(t, "key7[1].key3", c1["key7"].([]interface{})[1].(map[string]interface{})["key3"])
+	assert.Equal(t, "key2.key3", c1["key2"].(map[string]interface{})["key3"])
+
+	// Numeric keys index into lists, as in value expressions like `foo.1.bar`
+	path, _ := ParsePath("key7.0.key4")
+	v, err := path.Get(c1)
+	assert.NoError(t, err)
+	assert.Equal(t, "value7_4", v)
+
+	path, _ = ParsePath("key7[2].key3")
+	_, err = path.Get(c1)
+	var notFound *PathNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, "key7[2]", notFound.Missing.String())
+	assert.Error(t, path.Set(c1, "x"))
+}
+
+func TestFindPathAndValuesInNestedLists(t *testing.T) {
+	body := map[string]interface{}{}
+	json.Unmarshal([]byte(`{
+		"hls_abr_settings": {
+			"variants": [
+				{"video_params": {"video_width": "{{ live_hooks.result.width }}"}},
+				{"video_params": {"video_width": 1280}}
+			]
+		},
+		"matrix": [["a", "{{ live_hooks.result.b }}"], []]
+	}`), &body)
+
+	fm := map[string]string{}
+	for _, match := range FindPathAndValuesWithPattern(valueExpressionPattern, body, Path{}, []Match{}) {
+		fm[match.path.String()] = match.value
+	}
+	assert.Equal(t, map[string]string{
+		"hls_abr_settings.variants[0].video_params.video_width": "{{ live_hooks.result.width }}",
+		"matrix[0][1]": "{{ live_hooks.result.b }}",
+	}, fm)
+
+	activityResults := map[string]ActivityResult{
+		"live_hooks": {Result: map[string]interface{}{"width": float64(1920), "b": "bee"}},
+	}
+	activity := Activity{}
+	activity.RequestParams.Body = body
+	assert.NoError(t, ResolveValueExpressions(&activity, activityResults, WorkflowMetadata{}))
+	variants := body["hls_abr_settings"].(map[string]interface{})["variants"].([]interface{})
+	assert.Equal(t, float64(1920), variants[0].(map[string]interface{})["video_params"].(map[string]interface{})["video_width"])
+	assert.Equal(t, []interface{}{"a", "bee"}, body["matrix"].([]interface{})[0])
+}
+
+func TestParseWorkflowReservedName(t *testing.T) {
+	_, err := ParseWorkflow([]byte("activities:\n  - name: workflow\n"))
+	assert.Error(t, err)
+}